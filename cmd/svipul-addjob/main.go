@@ -71,41 +71,92 @@ func main() {
 	if expire.Milliseconds() < 1 {
 		svipul.Fatalf("TTL must be at least 1ms")
 	}
-	var bs [][]byte
-	args := flag.Args()
-	if len(os.Args) < 1 {
-		svipul.Fatalf("no order-file supplied")
+	// In reply mode, results come back on an exclusive queue of our
+	// own, matched to the orders by correlation ID.
+	var replies amqp.Queue
+	var msgs <-chan amqp.Delivery
+	pending := make(map[string]string)
+	if *reply {
+		if *sleeptime >= 0 {
+			svipul.Fatalf("-reply can't be combined with -sleep")
+		}
+		replies, err = ch.QueueDeclare(
+			"",    // name, chosen by the broker
+			false, // durable
+			true,  // delete when unused
+			true,  // exclusive
+			false, // no-wait
+			nil,   // arguments
+		)
+		if err != nil {
+			svipul.Fatalf("failed to declare reply queue: %s", err)
+		}
+		msgs, err = ch.Consume(replies.Name, "", true, true, false, false, nil)
+		if err != nil {
+			svipul.Fatalf("failed to consume replies: %s", err)
+		}
+	}
+	var jobs []job
+	if *target != "" {
+		b, err := flagOrder()
+		if err != nil {
+			svipul.Fatalf("invalid order: %s", err)
+		}
+		jobs = append(jobs, job{name: *target, body: b})
 	}
-	for _, fil := range args {
+	for _, fil := range flag.Args() {
 		b, err := os.ReadFile(fil)
 		if err != nil {
 			svipul.Fatalf("failed to read %s", fil)
 		}
-		bs = append(bs, b)
+		js, err := split(fil, b)
+		if err != nil {
+			svipul.Fatalf("invalid order file: %s", err)
+		}
+		jobs = append(jobs, js...)
+	}
+	if len(jobs) < 1 {
+		svipul.Fatalf("no order-file or -target supplied")
 	}
 	ttl := fmt.Sprintf("%d", expire.Milliseconds())
 	svipul.Debugf("expire: %s", ttl)
+	run := fmt.Sprintf("%d", time.Now().UnixNano())
 	for {
-		for idx, b := range bs {
+		for idx, j := range jobs {
+			msg := amqp.Publishing{
+				ContentType: "text/json",
+				Expiration:  ttl,
+				Timestamp:   time.Now(),
+				Body:        j.body,
+			}
+			if *reply {
+				msg.ReplyTo = replies.Name
+				msg.CorrelationId = fmt.Sprintf("%s-%d", run, idx)
+				pending[msg.CorrelationId] = j.name
+			}
 			err = ch.PublishWithContext(ctx,
 				"",     // exchange
 				q.Name, // routing key
 				false,  // mandatory
 				false,  // immediate
-				amqp.Publishing{
-					ContentType: "text/json",
-					Expiration:  ttl,
-					Body:        []byte(b),
-				})
+				msg)
 			if err != nil {
 				svipul.Fatalf("failed to publish a message: %s", err)
 			}
-			svipul.Logf("Sent %d bytes", len(b))
-			if *delay > 0 && idx < len(bs)-1 {
+			svipul.Logf("Sent %d bytes", len(j.body))
+			if *delay > 0 && idx < len(jobs)-1 {
 				svipul.Logf("Sleeping before next order: %s", delay)
 				time.Sleep(*delay)
 			}
 		}
+		if *reply {
+			failures := collect(msgs, pending, *timeout, os.Stdout, *jsonl)
+			if failures > 0 {
+				svipul.Logf("%d of %d orders failed or got no reply", failures, len(jobs))
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
 		if *sleeptime < 0 {
 			svipul.Logf("negative sleeptime, exiting after 1 publish")
 			os.Exit(0)
@@ -0,0 +1,168 @@
+/*
+ * svipul-addjob orders
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/telenornms/svipul"
+)
+
+// list is a flag that can be repeated, collecting every value.
+type list []string
+
+func (l *list) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *list) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+var target = flag.String("target", "", "compose an order for this target, CIDR prefix or range from the flags, instead of or in addition to order files")
+var mode = flag.String("mode", "Walk", "mode of the order, with -target")
+var oids list
+var elements list
+var key = flag.String("key", "", "map key to look up elements with, with -target. Blank means ifName")
+var id = flag.String("id", "", "ID of the order, with -target")
+var result = flag.String("result", "Auto", "how to format OIDs in the result: Auto, OID or Resolve, with -target")
+var from = flag.String("from", "", "first index to fetch, GetRange mode only, with -target. Blank means from the start")
+var to = flag.String("to", "", "last index to fetch, GetRange mode only, with -target. Blank means to the end")
+
+func init() {
+	flag.Var(&oids, "oid", "OID or name to fetch, with -target. Can be repeated")
+	flag.Var(&elements, "element", "element to fetch, GetElements mode only, with -target. Can be repeated")
+}
+
+// order is the part of an order svipul-addjob knows about. Mode and
+// Result are parsed the same way svipul-snmp does, so invalid orders are
+// caught before they are sent.
+type order struct {
+	Target   string
+	Targets  []string `json:",omitempty"`
+	Oids     []string `json:",omitempty"`
+	Elements []string `json:",omitempty"`
+	Key      string   `json:",omitempty"`
+	Mode     svipul.Mode
+	ID       string `json:",omitempty"`
+	Result   svipul.ResolveM
+	From     string `json:",omitempty"`
+	To       string `json:",omitempty"`
+}
+
+// job is a single order to publish, with a description for logs.
+type job struct {
+	name string
+	body []byte
+}
+
+// flagOrder composes an order from the command line flags.
+func flagOrder() ([]byte, error) {
+	o := order{
+		Target:   *target,
+		Oids:     oids,
+		Elements: elements,
+		Key:      *key,
+		ID:       *id,
+		From:     *from,
+		To:       *to,
+	}
+	var err error
+	if o.Mode, err = svipul.ParseMode(*mode); err != nil {
+		return nil, err
+	}
+	if o.Result, err = svipul.ParseResolveM(*result); err != nil {
+		return nil, err
+	}
+	switch o.Mode {
+	case svipul.Set:
+		return nil, fmt.Errorf("mode %s can't be composed from flags, use an order file", o.Mode)
+	case svipul.Walk, svipul.Get, svipul.GetNext, svipul.GetRange, svipul.GetElements:
+		if len(o.Oids) == 0 {
+			return nil, fmt.Errorf("mode %s needs at least one -oid", o.Mode)
+		}
+	}
+	if o.Mode == svipul.GetElements {
+		if len(o.Elements) == 0 {
+			return nil, fmt.Errorf("mode %s needs at least one -element", o.Mode)
+		}
+	} else if len(o.Elements) > 0 {
+		return nil, fmt.Errorf("-element only applies to mode %s", svipul.GetElements)
+	}
+	if o.Mode != svipul.GetRange && (o.From != "" || o.To != "") {
+		return nil, fmt.Errorf("-from and -to only apply to mode %s", svipul.GetRange)
+	}
+	return json.Marshal(o)
+}
+
+// split splits the content of an order file into one job per order. A
+// file holds a single order, a JSON array of orders, or JSON Lines with an
+// order on each line. The Mode and Result of every order are parsed, to
+// catch mistakes before they are sent.
+func split(name string, b []byte) ([]job, error) {
+	var raw []json.RawMessage
+	if bytes.HasPrefix(bytes.TrimSpace(b), []byte("[")) {
+		if err := json.Unmarshal(b, &raw); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(b))
+		for {
+			var r json.RawMessage
+			err := dec.Decode(&r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+			raw = append(raw, r)
+		}
+	}
+	if len(raw) == 0 {
+		return nil, fmt.Errorf("%s: no orders", name)
+	}
+	jobs := make([]job, 0, len(raw))
+	for i, r := range raw {
+		n := name
+		if len(raw) > 1 {
+			n = fmt.Sprintf("%s[%d]", name, i)
+		}
+		var o order
+		if err := json.Unmarshal(r, &o); err != nil {
+			return nil, fmt.Errorf("%s: %w", n, err)
+		}
+		if o.Target == "" && len(o.Targets) == 0 {
+			return nil, fmt.Errorf("%s: missing Target", n)
+		}
+		jobs = append(jobs, job{name: n, body: r})
+	}
+	return jobs, nil
+}
@@ -0,0 +1,134 @@
+/*
+ * svipul-addjob request/reply tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/telenornms/svipul"
+)
+
+func TestSplit(t *testing.T) {
+	cases := []struct {
+		in    string
+		names []string
+	}{
+		{`{"Target": "router1", "Mode": "Get", "Oids": ["sysName.0"]}`, []string{"f"}},
+		{`[{"Target": "router1"}, {"Target": "router2", "Result": "oid"}]`, []string{"f[0]", "f[1]"}},
+		{`{"Targets": ["router1", "192.0.2.0/28"]}`, []string{"f"}},
+		{"{\"Target\": \"router1\"}\n{\"Target\": \"router2\"}\n\n{\"Target\": \"router3\"}\n", []string{"f[0]", "f[1]", "f[2]"}},
+	}
+	for _, c := range cases {
+		jobs, err := split("f", []byte(c.in))
+		if err != nil {
+			t.Errorf("%s: %s", c.in, err)
+			continue
+		}
+		if len(jobs) != len(c.names) {
+			t.Errorf("%s: expected %d orders, got %d", c.in, len(c.names), len(jobs))
+			continue
+		}
+		for i, j := range jobs {
+			if j.name != c.names[i] {
+				t.Errorf("%s: expected name %s, got %s", c.in, c.names[i], j.name)
+			}
+			if !json.Valid(j.body) {
+				t.Errorf("%s: invalid body %s", c.in, j.body)
+			}
+		}
+	}
+	for _, bad := range []string{
+		``,
+		`[]`,
+		`{"Target": "router1", "Mode": "Dance"}`,
+		`[{"Target": "router1", "Result": "maybe"}]`,
+		`{"Mode": "Get"}`,
+		`{"Target": "router1"`,
+	} {
+		if _, err := split("f", []byte(bad)); err == nil {
+			t.Errorf("expected %q to fail", bad)
+		}
+	}
+}
+
+func TestFlagOrder(t *testing.T) {
+	*target = "router1"
+	*mode = "getelements"
+	*key = "ifName"
+	*result = "resolve"
+	oids = list{"ifHCInOctets", "ifHCOutOctets"}
+	elements = list{"ge-0/0/0"}
+	b, err := flagOrder()
+	if err != nil {
+		t.Fatalf("flagOrder failed: %s", err)
+	}
+	var o order
+	if err := json.Unmarshal(b, &o); err != nil {
+		t.Fatalf("can't parse %s: %s", b, err)
+	}
+	if o.Mode != svipul.GetElements || o.Result != svipul.Resolve || len(o.Oids) != 2 || o.Elements[0] != "ge-0/0/0" {
+		t.Errorf("unexpected order %s", b)
+	}
+
+	for _, c := range []struct{ mode, result string }{
+		{"Dance", "Auto"},
+		{"Get", "maybe"},
+		{"Set", "Auto"},
+		{"Walk", "Auto"}, // -element without GetElements
+	} {
+		*mode, *result = c.mode, c.result
+		if b, err := flagOrder(); err == nil {
+			t.Errorf("expected mode %s, result %s to fail, got %s", c.mode, c.result, b)
+		}
+	}
+	// The worker defaults the key to ifName
+	*mode, *key = "GetElements", ""
+	if b, err := flagOrder(); err != nil || strings.Contains(string(b), "Key") {
+		t.Errorf("expected GetElements without -key to leave it to the worker, got %s (%v)", b, err)
+	}
+
+	*mode, *from, *to = "GetRange", "10", "20"
+	elements = nil
+	b, err = flagOrder()
+	o = order{}
+	if err == nil {
+		err = json.Unmarshal(b, &o)
+	}
+	if err != nil || o.Mode != svipul.GetRange || o.From != "10" || o.To != "20" {
+		t.Errorf("unexpected GetRange order %s (%v)", b, err)
+	}
+	*mode = "Walk"
+	if b, err := flagOrder(); err == nil {
+		t.Errorf("expected -from and -to without GetRange to fail, got %s", b)
+	}
+	*from, *to = "", ""
+
+	*mode, *result = "Get", "Auto"
+	oids, elements = nil, nil
+	if b, err := flagOrder(); err == nil {
+		t.Errorf("expected Get without OIDs to fail, got %s", b)
+	}
+}
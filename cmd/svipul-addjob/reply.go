@@ -0,0 +1,144 @@
+/*
+ * svipul-addjob request/reply mode
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/telenornms/svipul"
+)
+
+var reply = flag.Bool("reply", false, "wait for the results of the orders and print them. Can't be combined with -sleep")
+var timeout = flag.Duration("timeout", 30*time.Second, "how long to wait for results, with -reply")
+var jsonl = flag.Bool("jsonl", false, "print results as JSON Lines instead of pretty JSON, with -reply")
+
+// verdict tells whether a reply is the last one for its order, and if so,
+// whether the order failed. Error results have the class of the error in
+// the "error" metadata, and "retry" set if the order will be retried, in
+// which case another reply follows.
+func verdict(body []byte) (final bool, failed bool) {
+	var c struct {
+		Metrics []struct {
+			Metadata map[string]interface{} `json:"metadata"`
+		} `json:"metrics"`
+	}
+	if err := json.Unmarshal(body, &c); err != nil {
+		return true, true
+	}
+	for _, m := range c.Metrics {
+		if _, ok := m.Metadata["error"]; !ok {
+			continue
+		}
+		if retry, _ := m.Metadata["retry"].(bool); retry {
+			return false, true
+		}
+		return true, true
+	}
+	return true, false
+}
+
+// parts returns how many final replies to expect for the message d is a
+// reply to. It's more than one when the message expanded to several
+// orders, e.g. an order for a CIDR prefix.
+func parts(d amqp.Delivery) int {
+	switch n := d.Headers["parts"].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	}
+	return 1
+}
+
+// collect prints the replies from msgs to out until every order in pending
+// (correlation ID to a description of the order) has a final reply, or the
+// timeout is reached. It returns the number of orders that failed or
+// didn't get a reply.
+func collect(msgs <-chan amqp.Delivery, pending map[string]string, timeout time.Duration, out io.Writer, lines bool) int {
+	failures := 0
+	left := make(map[string]int) // Final replies still expected, when more than one
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for len(pending) > 0 {
+		select {
+		case d, ok := <-msgs:
+			if !ok {
+				svipul.Logf("reply queue closed")
+				return failures + len(pending)
+			}
+			name, ok := pending[d.CorrelationId]
+			if !ok {
+				svipul.Debugf("ignoring reply with unknown correlation ID %q", d.CorrelationId)
+				continue
+			}
+			final, failed := verdict(d.Body)
+			printReply(out, d.Body, lines)
+			if !final {
+				svipul.Logf("%s: failed, waiting for retry", name)
+				continue
+			}
+			if failed {
+				failures++
+			}
+			if n := parts(d); n > 1 {
+				if _, ok := left[d.CorrelationId]; !ok {
+					left[d.CorrelationId] = n
+				}
+				left[d.CorrelationId]--
+				if left[d.CorrelationId] > 0 {
+					continue
+				}
+			}
+			delete(pending, d.CorrelationId)
+		case <-timer.C:
+			for _, name := range pending {
+				svipul.Logf("%s: no reply after %s", name, timeout)
+			}
+			return failures + len(pending)
+		}
+	}
+	return failures
+}
+
+// printReply writes a reply to out, on a single line or indented.
+func printReply(out io.Writer, body []byte, lines bool) {
+	var buf bytes.Buffer
+	var err error
+	if lines {
+		err = json.Compact(&buf, body)
+	} else {
+		err = json.Indent(&buf, body, "", "  ")
+	}
+	if err != nil {
+		buf.Reset()
+		buf.Write(body)
+	}
+	fmt.Fprintln(out, buf.String())
+}
@@ -0,0 +1,76 @@
+/*
+ * svipul-addjob request/reply tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestCollect(t *testing.T) {
+	ok := `{"metrics": [{"metadata": {"target": "router1"}, "data": {"sysName": "router1"}}]}`
+	retry := `{"metrics": [{"metadata": {"target": "router2", "error": "timeout", "retry": true}}]}`
+	failed := `{"metrics": [{"metadata": {"target": "router2", "error": "timeout", "retry": false}}]}`
+
+	msgs := make(chan amqp.Delivery, 4)
+	msgs <- amqp.Delivery{CorrelationId: "1", Body: []byte(ok)}
+	msgs <- amqp.Delivery{CorrelationId: "2", Body: []byte(retry)}
+	msgs <- amqp.Delivery{CorrelationId: "other", Body: []byte(ok)}
+	msgs <- amqp.Delivery{CorrelationId: "2", Body: []byte(failed)}
+	var out bytes.Buffer
+	n := collect(msgs, map[string]string{"1": "a.json", "2": "b.json"}, time.Second, &out, true)
+	if n != 1 {
+		t.Errorf("expected 1 failure, got %d", n)
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != 3 {
+		t.Errorf("expected 3 replies printed, got %d:\n%s", lines, out.String())
+	}
+
+	msgs <- amqp.Delivery{CorrelationId: "1", Body: []byte(ok)}
+	n = collect(msgs, map[string]string{"1": "a.json", "2": "b.json"}, 50*time.Millisecond, &out, false)
+	if n != 1 {
+		t.Errorf("expected the missing reply to count as a failure, got %d", n)
+	}
+
+	// A message for three targets gets three replies
+	three := amqp.Table{"parts": int32(3)}
+	msgs <- amqp.Delivery{CorrelationId: "1", Headers: three, Body: []byte(ok)}
+	msgs <- amqp.Delivery{CorrelationId: "1", Headers: three, Body: []byte(failed)}
+	n = collect(msgs, map[string]string{"1": "c.json"}, 50*time.Millisecond, &out, true)
+	if n != 2 {
+		t.Errorf("expected a failure and a missing reply, got %d", n)
+	}
+	msgs <- amqp.Delivery{CorrelationId: "1", Headers: three, Body: []byte(ok)}
+	msgs <- amqp.Delivery{CorrelationId: "1", Headers: three, Body: []byte(retry)}
+	msgs <- amqp.Delivery{CorrelationId: "1", Headers: three, Body: []byte(ok)}
+	msgs <- amqp.Delivery{CorrelationId: "1", Headers: three, Body: []byte(ok)}
+	n = collect(msgs, map[string]string{"1": "c.json"}, time.Second, &out, true)
+	if n != 0 {
+		t.Errorf("expected a reply to be retried not to count, got %d", n)
+	}
+}
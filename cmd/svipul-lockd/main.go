@@ -0,0 +1,63 @@
+/*
+ * svipul lock server
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+// svipul-lockd hands out target leases to svipul-snmp workers, so only one
+// worker in a cluster polls a given target at a time. See
+// inventory.HTTPLocker for the client side.
+//
+// Leases live in memory only. If svipul-lockd restarts, workers keep
+// polling what they're already polling, and renew their leases on the next
+// round.
+//
+// There is no authentication or TLS: anyone who can reach the listener can
+// take or release any lease, and so stall polling or have workers poll the
+// same device at once. It only listens on localhost by default, so
+// exposing it is an explicit choice: bind -listen to an address on a
+// trusted network, or put it behind something that authenticates.
+package main
+
+import (
+	"flag"
+	"net/http"
+	"time"
+
+	"github.com/telenornms/svipul"
+	"github.com/telenornms/svipul/inventory"
+)
+
+func main() {
+	var listen string
+	flag.BoolVar(&svipul.Config.Debug, "debug", false, "enable debug")
+	flag.StringVar(&listen, "listen", "127.0.0.1:8161", "address to listen on, only localhost by default")
+	flag.Parse()
+	svipul.Init()
+	m := &inventory.Memory{}
+	go func() {
+		for range time.Tick(time.Minute) {
+			m.Expire()
+		}
+	}()
+	svipul.Logf("Serving locks on %s", listen)
+	err := http.ListenAndServe(listen, inventory.NewLockHandler(m))
+	svipul.Fatalf("Listener failed: %s", err)
+}
@@ -0,0 +1,90 @@
+/*
+ * svipul-lockd tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/telenornms/svipul/inventory"
+)
+
+// TestProtocol checks the protocol as documented in svipul-lockd(1).
+func TestProtocol(t *testing.T) {
+	m := &inventory.Memory{}
+	srv := httptest.NewServer(inventory.NewLockHandler(m))
+	defer srv.Close()
+
+	cases := []struct {
+		method string
+		query  string
+		status int
+	}{
+		{http.MethodGet, "target=router1", http.StatusNotFound},
+		{http.MethodPut, "target=router1&owner=a&ttl=30s", http.StatusNoContent},
+		{http.MethodPut, "target=router1&owner=a&ttl=30s", http.StatusNoContent},
+		{http.MethodPut, "target=router1&owner=b&ttl=30s", http.StatusConflict},
+		{http.MethodGet, "target=router1", http.StatusOK},
+		{http.MethodDelete, "target=router1&owner=b", http.StatusConflict},
+		{http.MethodDelete, "target=router1&owner=a", http.StatusNoContent},
+		{http.MethodGet, "target=router1", http.StatusNotFound},
+		{http.MethodPut, "target=router1&owner=b&ttl=30s", http.StatusNoContent},
+		{http.MethodPut, "owner=a&ttl=30s", http.StatusBadRequest},
+		{http.MethodPut, "target=router1&ttl=30s", http.StatusBadRequest},
+		{http.MethodPut, "target=router1&owner=a", http.StatusBadRequest},
+		{http.MethodPut, "target=router1&owner=a&ttl=-1s", http.StatusBadRequest},
+		{http.MethodDelete, "target=router1", http.StatusBadRequest},
+		{http.MethodPost, "target=router1&owner=a&ttl=30s", http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		req, err := http.NewRequest(c.method, srv.URL+"/lock?"+c.query, nil)
+		if err != nil {
+			t.Fatalf("%s %s: %v", c.method, c.query, err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", c.method, c.query, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.status {
+			t.Errorf("%s %s: expected %d, got %d", c.method, c.query, c.status, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + "/lock?target=router1")
+	if err != nil {
+		t.Fatalf("unable to get lease: %v", err)
+	}
+	defer resp.Body.Close()
+	var l inventory.Lease
+	if err := json.NewDecoder(resp.Body).Decode(&l); err != nil {
+		t.Fatalf("unable to decode lease: %v", err)
+	}
+	if l.Owner != "b" || time.Until(l.Expires) <= 0 || time.Until(l.Expires) > 30*time.Second {
+		t.Errorf("unexpected lease %+v", l)
+	}
+}
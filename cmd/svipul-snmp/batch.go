@@ -0,0 +1,213 @@
+/*
+ * svipul multi-order messages
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/telenornms/svipul"
+)
+
+// batch tracks the orders of a message that expanded to more than one,
+// see parseOrders. A message can only be acknowledged or rejected as a
+// whole, so it is settled when the last of its orders is done:
+//
+//   - If any of the orders succeeded, the message is acknowledged.
+//   - If all of them failed, it is rejected without requeue, so it's
+//     dead-lettered if the queue has a dead letter exchange.
+//
+// Orders of a batch are never retried through redelivery, since that
+// would repeat the ones that went fine. A failed order gets an error
+// result of its own, with retry false, like any other order that isn't
+// retried.
+type batch struct {
+	lock   sync.Mutex
+	left   int // Orders not done yet
+	failed int
+	parts  int // Orders in total
+}
+
+// finish records the outcome of an order of the batch. It returns true
+// when it was the last one, along with whether the message should be
+// acknowledged.
+func (b *batch) finish(ok bool) (last bool, ack bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.left--
+	if !ok {
+		b.failed++
+	}
+	return b.left == 0, b.failed < b.parts
+}
+
+// parseOrders decodes the body of a message to the orders it holds: a
+// single order, or a JSON array of orders. Orders with more than one
+// target, see Order, are expanded to an order per target. Nothing is
+// returned unless the whole message is valid, and it can expand to at
+// most MaxTargets orders. When there is more than one order, they share a
+// batch.
+func parseOrders(body []byte) ([]Order, error) {
+	var in []Order
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		if err := json.Unmarshal(body, &in); err != nil {
+			return nil, err
+		}
+		if len(in) == 0 {
+			return nil, fmt.Errorf("empty array of orders")
+		}
+	} else {
+		var o Order
+		if err := json.Unmarshal(body, &o); err != nil {
+			return nil, err
+		}
+		in = append(in, o)
+	}
+	var out []Order
+	for i, o := range in {
+		targets, err := expand(o, svipul.Config.MaxTargets-len(out))
+		if err == nil && targets == nil && len(out) >= svipul.Config.MaxTargets {
+			err = fmt.Errorf("more than %d targets", svipul.Config.MaxTargets)
+		}
+		if err != nil {
+			if len(in) > 1 {
+				return nil, fmt.Errorf("order %d: %w", i, err)
+			}
+			return nil, err
+		}
+		if targets == nil {
+			out = append(out, o)
+			continue
+		}
+		for _, t := range targets {
+			sub := o
+			sub.Target = t
+			sub.Targets = nil
+			out = append(out, sub)
+		}
+	}
+	if len(out) > 1 {
+		b := &batch{left: len(out), parts: len(out)}
+		for i := range out {
+			out[i].batch = b
+		}
+	}
+	return out, nil
+}
+
+// expand returns the targets of o, with prefixes and ranges expanded, or
+// nil if o is a plain order for a single Target, which is left as is. It
+// fails if there are more than max targets.
+func expand(o Order, max int) ([]string, error) {
+	all := o.Targets
+	if o.Target != "" {
+		all = append([]string{o.Target}, all...)
+	}
+	if len(o.Targets) == 0 && !isRange(o.Target) {
+		return nil, nil
+	}
+	var targets []string
+	for _, t := range all {
+		var err error
+		targets, err = expandTarget(targets, t, max)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets")
+	}
+	return targets, nil
+}
+
+// isRange returns true if t is a CIDR prefix or a range of addresses.
+func isRange(t string) bool {
+	if _, err := netip.ParsePrefix(t); err == nil {
+		return true
+	}
+	first, _, found := strings.Cut(t, "-")
+	if !found {
+		return false
+	}
+	_, err := netip.ParseAddr(first)
+	return err == nil
+}
+
+// expandTarget appends the addresses of t to targets, if it's a CIDR
+// prefix or a range, otherwise t itself. IPv4 prefixes shorter than /31
+// leave out the network and broadcast addresses. Ranges are either
+// "first-last", or "first-n" where n replaces the last octet of an IPv4
+// address, both inclusive.
+func expandTarget(targets []string, t string, max int) ([]string, error) {
+	t = strings.TrimSpace(t)
+	if t == "" {
+		return nil, fmt.Errorf("blank target")
+	}
+	if p, err := netip.ParsePrefix(t); err == nil {
+		p = p.Masked()
+		edges := p.Addr().Is4() && p.Bits() < 31
+		for a := p.Addr(); a.IsValid() && p.Contains(a); a = a.Next() {
+			next := a.Next()
+			if edges && (a == p.Addr() || !next.IsValid() || !p.Contains(next)) {
+				continue
+			}
+			if len(targets) >= max {
+				return nil, fmt.Errorf("%s: more than %d targets", t, svipul.Config.MaxTargets)
+			}
+			targets = append(targets, a.String())
+		}
+		return targets, nil
+	}
+	a, b, found := strings.Cut(t, "-")
+	if !found || !isRange(t) {
+		if len(targets) >= max {
+			return nil, fmt.Errorf("more than %d targets", svipul.Config.MaxTargets)
+		}
+		return append(targets, t), nil
+	}
+	first, _ := netip.ParseAddr(a)
+	last, err := netip.ParseAddr(b)
+	if err != nil && first.Is4() {
+		var n uint64
+		n, err = strconv.ParseUint(b, 10, 8)
+		octets := first.As4()
+		octets[3] = byte(n)
+		last = netip.AddrFrom4(octets)
+	}
+	if err != nil || first.BitLen() != last.BitLen() || last.Less(first) {
+		return nil, fmt.Errorf("invalid range %q", t)
+	}
+	for a := first; a.IsValid() && !last.Less(a); a = a.Next() {
+		if len(targets) >= max {
+			return nil, fmt.Errorf("%s: more than %d targets", t, svipul.Config.MaxTargets)
+		}
+		targets = append(targets, a.String())
+	}
+	return targets, nil
+}
@@ -0,0 +1,113 @@
+/*
+ * svipul request/reply tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/telenornms/svipul"
+)
+
+func TestParseOrders(t *testing.T) {
+	cases := []struct {
+		body    string
+		targets string
+	}{
+		{`{"Target": "router1", "Mode": "Get", "Oids": ["sysName.0"]}`, "router1"},
+		{`{"Target": "router-1"}`, "router-1"},
+		{`{"Target": "192.0.2.1:1161"}`, "192.0.2.1:1161"},
+		{`[{"Target": "router1"}, {"Target": "router2", "Mode": "Walk"}]`, "router1 router2"},
+		{`{"Target": "router1", "Targets": ["router2", "192.0.2.9-11"]}`, "router1 router2 192.0.2.9 192.0.2.10 192.0.2.11"},
+		{`{"Targets": ["192.0.2.0/30"]}`, "192.0.2.1 192.0.2.2"},
+		{`{"Target": "192.0.2.4/31"}`, "192.0.2.4 192.0.2.5"},
+		{`{"Target": "192.0.2.7/32"}`, "192.0.2.7"},
+		{`{"Target": "192.0.2.254-192.0.3.1"}`, "192.0.2.254 192.0.2.255 192.0.3.0 192.0.3.1"},
+		{`{"Target": "2001:db8::/127"}`, "2001:db8:: 2001:db8::1"},
+		{`{"Target": "2001:db8::1-2001:db8::2"}`, "2001:db8::1 2001:db8::2"},
+	}
+	for _, c := range cases {
+		orders, err := parseOrders([]byte(c.body))
+		if err != nil {
+			t.Errorf("%s: %s", c.body, err)
+			continue
+		}
+		var got []string
+		for _, o := range orders {
+			got = append(got, o.Target)
+			if len(o.Targets) != 0 {
+				t.Errorf("%s: Targets left in %s", c.body, o.Target)
+			}
+			if (len(orders) > 1) != (o.batch != nil) {
+				t.Errorf("%s: %d orders, batch %v", c.body, len(orders), o.batch)
+			}
+		}
+		if strings.Join(got, " ") != c.targets {
+			t.Errorf("%s: expected targets %s, got %s", c.body, c.targets, strings.Join(got, " "))
+		}
+	}
+
+	max := svipul.Config.MaxTargets
+	defer func() { svipul.Config.MaxTargets = max }()
+	svipul.Config.MaxTargets = 4
+	for _, bad := range []string{
+		`[]`,
+		`{"Target": "router1", "Mode": "Dance"}`,
+		`[{"Target": "router1"}, {"Target": "router2", "Result": "maybe"}]`,
+		`{"Targets": ["router1", ""]}`,
+		`{"Target": "192.0.2.10-5"}`,
+		`{"Target": "192.0.2.10-256"}`,
+		`{"Target": "192.0.2.1-2001:db8::1"}`,
+		`{"Target": "192.0.2.0/29"}`,
+		`{"Target": "2001:db8::/64"}`,
+		`[{"Target": "192.0.2.1-3"}, {"Targets": ["router1", "router2"]}]`,
+		`[{"Target": "r1"}, {"Target": "r2"}, {"Target": "r3"}, {"Target": "r4"}, {"Target": "r5"}]`,
+		`[{"Target": "192.0.2.1-3"}, {"Target": "router1"}, {"Target": "router2"}]`,
+	} {
+		if orders, err := parseOrders([]byte(bad)); err == nil {
+			t.Errorf("expected %s to fail, got %d orders", bad, len(orders))
+		}
+	}
+	full := `[{"Target": "r1"}, {"Target": "r2"}, {"Target": "192.0.2.1-2"}]`
+	if orders, err := parseOrders([]byte(full)); err != nil || len(orders) != 4 {
+		t.Errorf("expected %s to give 4 orders, got %d: %v", full, len(orders), err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	b := &batch{left: 3, parts: 3}
+	if last, _ := b.finish(false); last {
+		t.Errorf("first of three orders was last")
+	}
+	b.finish(true)
+	if last, ack := b.finish(false); !last || !ack {
+		t.Errorf("expected the last order to settle with ack, got %v %v", last, ack)
+	}
+
+	b = &batch{left: 2, parts: 2}
+	b.finish(false)
+	if last, ack := b.finish(false); !last || ack {
+		t.Errorf("expected a batch where everything failed to be rejected, got %v %v", last, ack)
+	}
+}
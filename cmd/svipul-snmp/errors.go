@@ -0,0 +1,172 @@
+/*
+ * svipul error results
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/telenornms/skogul"
+	"github.com/telenornms/svipul"
+	"github.com/telenornms/svipul/inventory"
+	"github.com/telenornms/svipul/session"
+)
+
+// ErrorClass is the kind of failure of an order, see Engine.Failed.
+type ErrorClass string
+
+const (
+	Timeout  ErrorClass = "timeout"  // The target didn't answer
+	Auth     ErrorClass = "auth"     // Credentials rejected or unknown
+	LockBusy ErrorClass = "lockbusy" // The target was busy with other orders for too long
+	Lookup   ErrorClass = "lookup"   // An OID or value couldn't be looked up in the MIBs
+	Send     ErrorClass = "send"     // The result couldn't be sent on through skogul
+	Circuit  ErrorClass = "circuit"  // The circuit breaker of the target is open
+	Deadline ErrorClass = "deadline" // The order ran out of time
+	Other    ErrorClass = "other"
+)
+
+// classified is an error with its class set where it happened, for the
+// failures that can't be told apart by the error itself.
+type classified struct {
+	class ErrorClass
+	err   error
+}
+
+func (c classified) Error() string {
+	return c.err.Error()
+}
+
+func (c classified) Unwrap() error {
+	return c.err
+}
+
+// classify marks err as being of class.
+func classify(class ErrorClass, err error) error {
+	return classified{class: class, err: err}
+}
+
+// lockFailed classifies a failure of LockHost. Only a busy target is
+// LockBusy: an unknown credential is left for classOf to find, and a
+// failing lock backend is Other.
+func lockFailed(err error) error {
+	if errors.Is(err, inventory.ErrUnknownCredential) || errors.Is(err, inventory.ErrLockBackend) {
+		return err
+	}
+	return classify(LockBusy, err)
+}
+
+// classOf returns the class of an error returned by Run. expired is true
+// if the order ran out of time.
+func classOf(err error, expired bool) ErrorClass {
+	var c classified
+	switch {
+	case expired:
+		return Deadline
+	case errors.As(err, &c):
+		return c.class
+	case errors.Is(err, session.ErrCircuitOpen):
+		return Circuit
+	case session.IsTimeout(err):
+		return Timeout
+	case errors.Is(err, inventory.ErrUnknownCredential),
+		errors.Is(err, gosnmp.ErrUnknownUsername), errors.Is(err, gosnmp.ErrWrongDigest),
+		errors.Is(err, gosnmp.ErrDecryption), errors.Is(err, gosnmp.ErrUnknownSecurityLevel),
+		strings.Contains(err.Error(), gosnmp.AuthorizationError.String()),
+		strings.Contains(err.Error(), gosnmp.NoAccess.String()):
+		return Auth
+	}
+	return Other
+}
+
+// attempt returns which attempt at the order this is, counting from 1.
+// Quorum queues count deliveries, classic queues only tell us if it's
+// been delivered before, and we only requeue once.
+func attempt(d amqp.Delivery) int {
+	switch n := d.Headers["x-delivery-count"].(type) {
+	case int64:
+		return int(n) + 1
+	case int32:
+		return int(n) + 1
+	}
+	if d.Redelivered {
+		return 2
+	}
+	return 1
+}
+
+// retry returns true if a failed order should be put back on the queue,
+// which is done once. An order that ran out of time is not retried, it
+// would most likely just run out of time again, and whoever sent it has
+// given up on it by now anyway. Same for targets behind an open circuit
+// breaker. Set orders are never retried: a Set that failed, e.g. timed
+// out, may still have been carried out by the agent, and writes should
+// happen at most once.
+func retry(o Order, err error, expired bool) bool {
+	switch {
+	case o.delivery.Redelivered, expired, o.batch != nil, o.Mode == svipul.Set:
+		return false
+	case errors.Is(err, session.ErrCircuitOpen):
+		return false
+	}
+	return true
+}
+
+// Failed sends a result for an order that failed, so whoever sent it
+// learns about it. It goes to the svipul-errors handler if there is one
+// in the skogul config, otherwise to the svipul handler with the regular
+// results. The metadata has the target, id and mode of the order, the
+// class of the error, the attempt number and whether the order will be
+// retried. The data is the error message, as Error. It is also the reply
+// to the order, if it asked for one.
+func (e *Engine) Failed(o Order, err error, class ErrorClass, retry bool) {
+	m := skogul.Metric{}
+	now := time.Now()
+	m.Time = &now
+	m.Metadata = map[string]interface{}{
+		"target":  o.Target,
+		"mode":    o.Mode.String(),
+		"error":   string(class),
+		"attempt": attempt(o.delivery),
+		"retry":   retry,
+	}
+	if o.ID != "" {
+		m.Metadata["id"] = o.ID
+	}
+	m.Data = map[string]interface{}{"Error": err.Error()}
+	c := skogul.Container{}
+	c.Metrics = append(c.Metrics, &m)
+	body := replyBody(o, &c)
+	h := e.Skogul.Handlers["svipul-errors"]
+	if h == nil {
+		h = e.Skogul.Handlers["svipul"]
+	}
+	if err := h.Handler.TransformAndSend(&c); err != nil {
+		svipul.Logf("%s: unable to send error result: %s", o.Target, err)
+	}
+	e.reply(o, body)
+}
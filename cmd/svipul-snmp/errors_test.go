@@ -0,0 +1,105 @@
+/*
+ * svipul error result tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/telenornms/svipul"
+	"github.com/telenornms/svipul/inventory"
+	"github.com/telenornms/svipul/session"
+)
+
+func TestClassOf(t *testing.T) {
+	_, unknown := inventory.LookupCredential("no-such-credential")
+	cases := []struct {
+		err     error
+		expired bool
+		class   ErrorClass
+	}{
+		{fmt.Errorf("snmp get/walk failed: %w", errors.New("request timeout (after 1 retries)")), false, Timeout},
+		{fmt.Errorf("snmp get/walk failed: %w", context.DeadlineExceeded), true, Deadline},
+		{fmt.Errorf("session creation failed: %w", session.ErrCircuitOpen), false, Circuit},
+		{fmt.Errorf("Get failed: %w", gosnmp.ErrWrongDigest), false, Auth},
+		{fmt.Errorf("snmp set failed: response error: %s (index 1)", gosnmp.NoAccess), false, Auth},
+		{fmt.Errorf("order: %w", classify(LockBusy, errors.New("target still locked"))), false, LockBusy},
+		{lockFailed(errors.New("target still locked after waiting 1m0s behind 2 other orders")), false, LockBusy},
+		{lockFailed(fmt.Errorf("%w: held by worker2", inventory.ErrLocked)), false, LockBusy},
+		{lockFailed(fmt.Errorf("inventory entry for router1: %w", unknown)), false, Auth},
+		{lockFailed(fmt.Errorf("%w: %w", inventory.ErrLockBackend, errors.New("connection refused"))), false, Other},
+		{fmt.Errorf("credential: %w", unknown), false, Auth},
+		{classify(Send, errors.New("send failed")), false, Send},
+		{errors.New("unsupported mode"), false, Other},
+	}
+	for _, c := range cases {
+		if class := classOf(c.err, c.expired); class != c.class {
+			t.Errorf("expected %q to be %s, got %s", c.err, c.class, class)
+		}
+	}
+}
+
+func TestAttempt(t *testing.T) {
+	cases := []struct {
+		d       amqp.Delivery
+		attempt int
+	}{
+		{amqp.Delivery{}, 1},
+		{amqp.Delivery{Redelivered: true}, 2},
+		{amqp.Delivery{Redelivered: true, Headers: amqp.Table{"x-delivery-count": int64(3)}}, 4},
+	}
+	for _, c := range cases {
+		if n := attempt(c.d); n != c.attempt {
+			t.Errorf("expected attempt %d for %+v, got %d", c.attempt, c.d, n)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	timeout := fmt.Errorf("snmp get/walk failed: %w", errors.New("request timeout (after 1 retries)"))
+	cases := []struct {
+		o       Order
+		err     error
+		expired bool
+		retry   bool
+	}{
+		{Order{Mode: svipul.Get}, timeout, false, true},
+		{Order{Mode: svipul.Walk}, errors.New("unsupported mode"), false, true},
+		{Order{Mode: svipul.Get, delivery: amqp.Delivery{Redelivered: true}}, timeout, false, false},
+		{Order{Mode: svipul.Get}, timeout, true, false},
+		{Order{Mode: svipul.Get}, fmt.Errorf("session creation failed: %w", session.ErrCircuitOpen), false, false},
+		{Order{Mode: svipul.Get, batch: &batch{}}, timeout, false, false},
+		{Order{Mode: svipul.Set}, fmt.Errorf("snmp set failed: %w", timeout), false, false},
+		{Order{Mode: svipul.Set}, errors.New("invalid set"), false, false},
+	}
+	for _, c := range cases {
+		if r := retry(c.o, c.err, c.expired); r != c.retry {
+			t.Errorf("%s order failing with %q (expired: %v): expected retry %v, got %v", c.o.Mode, c.err, c.expired, c.retry, r)
+		}
+	}
+}
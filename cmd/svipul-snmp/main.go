@@ -27,13 +27,19 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"math/rand"
 	"net/url"
+	"os"
+	"os/signal"
 	"regexp"
-	"strings"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gosnmp/gosnmp"
@@ -41,8 +47,6 @@ import (
 	"github.com/telenornms/skogul"
 	sconfig "github.com/telenornms/skogul/config"
 	"github.com/telenornms/svipul"
-	//	"github.com/sleepinggenius2/gosmi/models"
-	"github.com/sleepinggenius2/gosmi/types"
 	"github.com/telenornms/svipul/inventory"
 	"github.com/telenornms/svipul/omap"
 	"github.com/telenornms/svipul/session"
@@ -53,13 +57,16 @@ import (
 type Task struct {
 	OMap   *omap.OMap    // Engine populates uniquely for each target
 	Metric skogul.Metric // New metric for each run.
-	Result ResolveM
+	Result svipul.ResolveM
 }
 
 // Engine is semi-global state for SNMP, including a "cached" OMap ... map
 type Engine struct {
 	Skogul *sconfig.Config                  // output
 	OMap   map[string]map[string]*omap.OMap // Caches/stores looked up/built omaps
+
+	replies   *amqp.Channel // For replies to orders with a ReplyTo, see reply
+	replyLock sync.Mutex
 }
 
 // Init reads configuration and whatnot for the engine
@@ -80,8 +87,20 @@ func (e *Engine) Init(sc string) error {
 	return nil
 }
 
+// send sends the results of o on through the svipul handler, and to the
+// reply queue of o, if it has one.
+func (e *Engine) send(o Order, c *skogul.Container) error {
+	body := replyBody(o, c)
+	err := e.Skogul.Handlers["svipul"].Handler.TransformAndSend(c)
+	if err != nil {
+		return classify(Send, fmt.Errorf("send failed: %w", err))
+	}
+	e.reply(o, body)
+	return nil
+}
+
 // GetOmap builds an omap on demand, or returns an already built one
-func (e *Engine) GetOmap(target string, key string, sess *session.Session) (*omap.OMap, error) {
+func (e *Engine) GetOmap(ctx context.Context, target string, key string, sess *session.Session) (*omap.OMap, error) {
 	var err error
 	if e.OMap[target][key] != nil {
 		if time.Since(e.OMap[target][key].Timestamp) > svipul.Config.MaxMapAge {
@@ -91,7 +110,7 @@ func (e *Engine) GetOmap(target string, key string, sess *session.Session) (*oma
 			return e.OMap[target][key], nil
 		}
 	}
-	o, err := omap.BuildOMap(sess, key)
+	o, err := omap.BuildOMap(ctx, sess, key)
 	if err != nil {
 		return nil, fmt.Errorf("failed to build IF-map: %w", err)
 	}
@@ -119,19 +138,155 @@ func (e *Engine) ClearOmap(target string, key string) error {
 	return nil
 }
 
+// Breaker reports the circuit breaker state of a target, after clearing
+// it if the mode is ClearBreaker. The state is the data of the result,
+// e.g. {"State": "open", "Timeouts": 5, ...}. Breakers are kept by the
+// address of the target, so it is looked up in the inventory.
+func (e *Engine) Breaker(o Order) error {
+	addr := inventory.Address(o.Target)
+	if o.Mode == svipul.ClearBreaker {
+		svipul.Logf("Clearing circuit breaker for %s on request", o.Target)
+		session.ClearBreaker(addr)
+	}
+	state := session.Breaker(addr)
+	m := skogul.Metric{}
+	now := time.Now()
+	m.Time = &now
+	m.Metadata = map[string]interface{}{"target": o.Target}
+	if o.ID != "" {
+		m.Metadata["id"] = o.ID
+	}
+	m.Data = map[string]interface{}{
+		"State":    state.State,
+		"Timeouts": state.Timeouts,
+	}
+	if !state.Opened.IsZero() {
+		m.Data["Opened"] = state.Opened
+		m.Data["Until"] = state.Until
+		m.Data["LastError"] = state.LastError
+	}
+	c := skogul.Container{}
+	c.Metrics = append(c.Metrics, &m)
+	return e.send(o, &c)
+}
+
+// Probe tries the ProbeCredentials of the configuration against the
+// target in order, with the timing of the order, and remembers the first
+// that works for later orders without credentials. Unless the order says
+// otherwise, each attempt is a single request without retries.
+//
+// The result is sent on, with the name of the credential, the version and
+// v3 user name (never the secrets), how many attempts it took and the
+// sysUpTime and sysObjectID of the target. If nothing works, Found is
+// false and what was remembered for the target is forgotten.
+func (e *Engine) Probe(ctx context.Context, o Order, host inventory.Host) error {
+	if len(svipul.Config.ProbeCredentials) == 0 {
+		return fmt.Errorf("no ProbeCredentials configured")
+	}
+	if err := o.Timing.Validate(); err != nil {
+		return fmt.Errorf("invalid timing parameters: %w", err)
+	}
+	timing := o.Timing.Merge(host.Timing)
+	if timing.Retries == nil {
+		noRetries := 0
+		timing.Retries = &noRetries
+	}
+	if o.Transport != "" {
+		host.Transport = o.Transport
+	}
+	m := skogul.Metric{}
+	m.Metadata = map[string]interface{}{"target": o.Target}
+	if o.ID != "" {
+		m.Metadata["id"] = o.ID
+	}
+	m.Data = map[string]interface{}{"Found": false}
+	var errs []string
+	for i, c := range svipul.Config.ProbeCredentials {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		h := host
+		h.Use(c)
+		h.Timing = timing
+		uptime, objectID, err := session.Probe(ctx, h)
+		m.Data["Attempts"] = i + 1
+		if err != nil {
+			svipul.Debugf("%s: probing with credential %s failed: %s", o.Target, name, err)
+			errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+		inventory.Remember(o.Target, c)
+		svipul.Logf("%s: credential %s works, remembering it", o.Target, name)
+		m.Data["Found"] = true
+		m.Data["Credential"] = name
+		m.Data["Version"] = c.Version
+		if c.V3 != nil {
+			m.Data["Username"] = c.V3.Username
+			if c.Version == "" {
+				m.Data["Version"] = "3"
+			}
+		} else if c.Version == "" {
+			m.Data["Version"] = "2c"
+		}
+		m.Data["sysUpTime"] = uptime
+		m.Data["sysObjectID"] = objectID
+		break
+	}
+	if m.Data["Found"] == false {
+		inventory.Forget(o.Target)
+		m.Data["Errors"] = errs
+		svipul.Logf("%s: no working credentials found after %d attempts", o.Target, len(errs))
+	}
+	now := time.Now()
+	m.Time = &now
+	c := skogul.Container{}
+	c.Metrics = append(c.Metrics, &m)
+	return e.send(o, &c)
+}
+
 // Run starts an SNMP session for a target and collects the specified oids,
 // if emap is true, it will use an oid/element map, building it on demand.
+// The run is aborted as soon as ctx is done, or the lease on the target is
+// lost.
 //
 // TODO: This needs to be split up and possibly refactored. It's a bit of a
 // beast.
-func (e *Engine) Run(o Order) error {
-	host, err := inventory.LockHost(o.Target)
+func (e *Engine) Run(ctx context.Context, o Order) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// The breaker is inspected without the host lock, so it can be
+	// done while an order for the target is running.
+	if o.Mode == svipul.Breaker || o.Mode == svipul.ClearBreaker {
+		return e.Breaker(o)
+	}
+	host, err := inventory.LockHost(ctx, o.Target)
 	if err != nil {
-		return fmt.Errorf("unable to acquire host lock: %w", err)
+		return lockFailed(fmt.Errorf("unable to acquire host lock: %w", err))
 	}
 	defer host.Unlock()
-	if o.Mode == ClearMap {
-		return e.ClearOmap(o.Target, o.Key)
+	ctx = host.Context()
+	defer func() {
+		if err != nil && errors.Is(context.Cause(ctx), inventory.ErrLeaseLost) {
+			err = classify(LockBusy, fmt.Errorf("%w: %w", inventory.ErrLeaseLost, err))
+		}
+	}()
+	if o.Mode == svipul.ClearMap {
+		err := e.ClearOmap(o.Target, o.Key)
+		if err == nil {
+			e.done(o)
+		}
+		return err
+	}
+	if o.Mode == svipul.Probe {
+		return e.Probe(ctx, o, host)
+	}
+	if o.Mode == svipul.Set && !setAllowed(o.Target) {
+		return fmt.Errorf("set is not allowed for %s", o.Target)
 	}
 	if o.Elements != nil && len(o.Elements) > 0 {
 		if o.Key == "" {
@@ -140,18 +295,42 @@ func (e *Engine) Run(o Order) error {
 		}
 	}
 
-	community := host.Community
+	if o.Credential != "" {
+		c, err := inventory.LookupCredential(o.Credential)
+		if err != nil {
+			return classify(Auth, err)
+		}
+		host.Use(c)
+	}
 	if o.Community != "" {
-		community = o.Community
+		host.Community = o.Community
+	}
+	if o.V3 != nil {
+		host.V3 = o.V3
+		host.Version = "3"
+	}
+	if o.Version != "" {
+		host.Version = o.Version
 	}
-	sess, err := session.NewSession(o.Target, community)
+	if o.Transport != "" {
+		host.Transport = o.Transport
+	}
+	if err := o.Timing.Validate(); err != nil {
+		return fmt.Errorf("invalid timing parameters: %w", err)
+	}
+	host.Timing = o.Timing.Merge(host.Timing)
+	sess, err := session.NewSession(host)
 	if err != nil {
 		return fmt.Errorf("session creation failed: %w", err)
 	}
 	defer sess.Finalize()
 	svipul.Debugf("%s - starting run", o.Target)
 
-	if o.Mode == BuildMap {
+	if o.Mode == svipul.Set {
+		return e.Set(ctx, o, sess)
+	}
+
+	if o.Mode == svipul.BuildMap {
 		if o.Key == "" {
 			svipul.Debugf("Requested building of a map, but no key provided. Assuming ifName")
 			o.Key = "ifName"
@@ -161,16 +340,17 @@ func (e *Engine) Run(o Order) error {
 		if err != nil {
 			return fmt.Errorf("unable to clear omap: %w", err)
 		}
-		_, err = e.GetOmap(o.Target, o.Key, sess)
+		_, err = e.GetOmap(ctx, o.Target, o.Key, sess)
 		if err != nil {
 			return fmt.Errorf("unable to build omap: %w", err)
 		}
+		e.done(o)
 		return nil
 	}
 
 	t := Task{}
 	if o.Key != "" {
-		t.OMap, err = e.GetOmap(o.Target, o.Key, sess)
+		t.OMap, err = e.GetOmap(ctx, o.Target, o.Key, sess)
 		if err != nil {
 			return fmt.Errorf("failed to build IF-map: %w", err)
 		}
@@ -181,18 +361,18 @@ func (e *Engine) Run(o Order) error {
 	for _, arg := range o.Oids {
 		nym, err := smierte.Lookup(arg)
 		if err != nil {
-			return fmt.Errorf("unable to look up oid: %w", err)
+			return classify(Lookup, fmt.Errorf("unable to look up oid: %w", err))
 		}
 		m = append(m, nym)
 		if nym.Lookedup {
 			lookedup = true
 		}
 	}
-	if o.Result == Auto {
+	if o.Result == svipul.Auto {
 		if lookedup {
-			t.Result = Resolve
+			t.Result = svipul.Resolve
 		} else {
-			t.Result = OID
+			t.Result = svipul.OID
 		}
 	} else {
 		t.Result = o.Result
@@ -205,8 +385,11 @@ func (e *Engine) Run(o Order) error {
 	if o.ID != "" {
 		t.Metric.Metadata["id"] = o.ID
 	}
+	if len(host.Tags) > 0 {
+		t.Metric.Metadata["tags"] = host.Tags
+	}
 	t.Metric.Data = make(map[string]interface{})
-	if o.Mode == GetElements {
+	if o.Mode == svipul.GetElements {
 		nym := make([]svipul.Node, 0, len(m)*len(o.Elements))
 		for _, oid := range m {
 			for _, e := range o.Elements {
@@ -222,30 +405,49 @@ func (e *Engine) Run(o Order) error {
 				}
 			}
 		}
-		err = sess.Get(nym, t.bwCB)
-	} else if o.Mode == Walk {
-		err = sess.BulkWalk(m, t.bwCB)
-	} else if o.Mode == Get {
-		err = sess.Get(m, t.bwCB)
+		err = sess.Get(ctx, nym, t.bwCB)
+	} else if o.Mode == svipul.Walk {
+		err = sess.BulkWalk(ctx, m, t.bwCB)
+	} else if o.Mode == svipul.Get {
+		err = sess.Get(ctx, m, t.bwCB)
+	} else if o.Mode == svipul.GetNext {
+		err = sess.GetNext(ctx, m, t.bwCB)
+	} else if o.Mode == svipul.GetRange {
+		err = sess.GetRange(ctx, m, o.From, o.To, t.bwCB)
 	} else {
 		return fmt.Errorf("unsupported mode")
 	}
 	if err != nil {
 		return fmt.Errorf("snmp get/walk failed: %w", err)
 	}
+	t.setMissing(sess.Missing)
 	c := skogul.Container{}
 	c.Metrics = append(c.Metrics, &t.Metric)
 
-	err = e.Skogul.Handlers["svipul"].Handler.TransformAndSend(&c)
-	if err != nil {
-		return fmt.Errorf("send failed: %w", err)
+	return e.send(o, &c)
+}
+
+// setMissing adds the requested OIDs that yielded nothing, and why, to the
+// metadata as "missing". The OIDs are resolved to names unless the result
+// mode is OID.
+func (t *Task) setMissing(missing map[string]string) {
+	if len(missing) == 0 {
+		return
+	}
+	m := make(map[string]interface{})
+	for oid, reason := range missing {
+		name := oid
+		if t.Result != svipul.OID {
+			name = smierte.Name(oid)
+		}
+		m[name] = reason
 	}
-	return nil
+	t.Metric.Metadata["missing"] = m
 }
 
 // saveNode stores a result
 func (t *Task) saveNode(pdu gosnmp.SnmpPDU, v interface{}) error {
-	if t.Result == OID {
+	if t.Result == svipul.OID {
 		t.Metric.Data[pdu.Name] = v
 		return nil
 	}
@@ -281,59 +483,23 @@ func (t *Task) saveNode(pdu gosnmp.SnmpPDU, v interface{}) error {
 
 // bwCB is the callback used for each PDU received during an SNMP GET of
 // some sort. It just "decodes" the value and triggers storage.
-//
-// The decoding is a bit finnicky. We only want to use the "formatted"
-// stuff for types that require rendering, while numbers should be left
-// intact. And then there's OctetString where we DO want to use DisplayHint
-// if present, but NOT if it isn't present, because the default is
-// atrocious.
 func (t *Task) bwCB(pdu gosnmp.SnmpPDU) error {
-	var v interface{}
-	node, err := smierte.Lookup(pdu.Name)
-	if err != nil {
-		svipul.Logf("PDU/Node lookup failed during callback: %v", err)
-	}
-	if node.Type == nil {
-		return t.saveNode(pdu, pdu.Value)
-	}
-	foo := node.Type.FormatValue(pdu.Value)
-	if node.Type.BaseType == types.BaseTypeUnknown ||
-		node.Type.BaseType == types.BaseTypeObjectIdentifier ||
-		node.Type.BaseType == types.BaseTypeEnum ||
-		node.Type.BaseType == types.BaseTypeBits ||
-		node.Type.BaseType == types.BaseTypePointer {
-		v = foo.Formatted
-	} else if node.Type.BaseType == types.BaseTypeOctetString {
-		if node.Type.Format == "" {
-			switch foo.Raw.(type) {
-			case string:
-				v = foo.Raw
-			case []uint8:
-				// This one is a bit iffy, since I
-				// don't know if there are
-				// problematic octet strings out
-				// there, but I _do_ know
-				// hrSWInstalledName will fail to
-				// render sensibly without it.
-				v = string(foo.Raw.([]uint8))
-			default:
-				v = foo.Formatted
-			}
-		} else {
-			v = foo.Formatted
-		}
-	} else {
-		v = pdu.Value
-	}
-
-	return t.saveNode(pdu, v)
+	return t.saveNode(pdu, smierte.Value(pdu))
 }
 
 // Order is the central object for kicking Svipul into action. An order
 // always operates on a target (a host/switch, either IP address or
-// hostname) and using a mode. Depending on the mode, Svipul can either
-// request OIDS from the target system, build table/element maps or clear
-// the map cache. There are more than one method of getting OIDS.
+// hostname, optionally with a port, e.g. "router1:1161" or
+// "[2001:db8::1]:1161") and using a mode. Depending on the mode, Svipul
+// can either request OIDS from the target system, build table/element
+// maps or clear the map cache. There are more than one method of getting OIDS.
+//
+// Targets lists more targets for the same order. Target and Targets can
+// also be CIDR prefixes, e.g. "192.0.2.0/28", or ranges of addresses, e.g.
+// "192.0.2.10-192.0.2.20" or "192.0.2.10-20". The order is carried out
+// for every address, as an order of its own. A message can also hold a
+// JSON array of orders. See parseOrders and batch for how such messages
+// are acknowledged.
 //
 // OIDs can be provided either as a list of numeric IDs, or by the symbolic
 // names. E.g.: .1.3.6.1.2.1.1.5.0 is valid, but so is ifHCInOctets. At the
@@ -351,6 +517,22 @@ func (t *Task) bwCB(pdu gosnmp.SnmpPDU) error {
 //
 // Community is the community to use to connect to the host.
 //
+// V3 holds SNMPv3 security parameters (user name, security level,
+// authentication/privacy protocols and passphrases, context). If provided,
+// SNMPv3 is used instead of v2c and Community is ignored.
+//
+// Version selects the SNMP version: 1, 2c or 3. If blank, it is 3 if V3 is
+// provided, otherwise it's up to the worker (default: 2c). SNMPv1 targets
+// are walked using GetNext, since v1 has no GetBulk.
+//
+// Transport is the transport protocol to use: udp (default), udp4, udp6,
+// tcp, tcp4 or tcp6.
+//
+// The embedded Timing allows overriding Timeout, Retries,
+// ExponentialTimeout, MaxOids (per Get request) and MaxRepetitions (for
+// GetBulk) for this order. Unset values are taken from the inventory or
+// the configuration.
+//
 // ID is an optional identification which is not used by Svipul at all, but
 // included in the result to allow a caller to match the order to the
 // result.
@@ -360,145 +542,188 @@ func (t *Task) bwCB(pdu gosnmp.SnmpPDU) error {
 // used in the output. If symbolic names were used, that's used for the
 // result by default. This behavior can be overridden by providing "oid" to
 // leave OIDs unresolved and "Resolve" to attempt to always resolve them.
+//
+// Set holds the values to write in Set mode. Set is disabled unless the
+// worker configuration has AllowSet enabled and the target is listed in
+// SetTargets.
+//
+// From and To are the first and last index (both inclusive) to fetch in
+// GetRange mode, e.g. "10" and "20" for ifName.10 through ifName.20.
+// Either can be left blank to leave that end of the range open.
+//
+// MaxTime is how long the entire order may take, e.g. "30s", counted from
+// when it is received. It overrides MaxOrderTime of the configuration. If
+// the message has an expiration, the order is also given up when the
+// message expires, whichever comes first.
 type Order struct {
-	Target    string   // Host/target
-	Oids      []string // OIDs, also accepts logical names (e.g.: ifName)
-	Elements  []string // Elemnts, if GetElements mode. Elements == interfaces (could be other in the future)
-	Key       string   // Map key to use for looking up elements
-	Mode      Mode     // What mode to use
-	Community string   `json:",omitempty"` // Community to use, blank == figure it out yourself/use default (meaning depends on issuer)
-	ID        string   `json:",omitempty"`
-	Result    ResolveM // Auto (default) = resolve based on input, OID = leave OIDs unresolved, Resolve = try to resolve
-	delivery  amqp.Delivery
+	Target     string          // Host/target
+	Targets    []string        `json:",omitempty"` // More targets, see above
+	Oids       []string        // OIDs, also accepts logical names (e.g.: ifName)
+	Elements   []string        // Elemnts, if GetElements mode. Elements == interfaces (could be other in the future)
+	Key        string          // Map key to use for looking up elements
+	Mode       svipul.Mode     // What mode to use
+	Community  string          `json:",omitempty"` // Community to use, blank == figure it out yourself/use default (meaning depends on issuer)
+	Credential string          `json:",omitempty"` // Named credential, resolved by the worker, see Secrets
+	V3         *svipul.V3      `json:",omitempty"` // SNMPv3 parameters, nil == use v2c
+	Version    string          `json:",omitempty"` // SNMP version: 1, 2c or 3. Blank == 3 if V3 is set, otherwise default
+	Transport  string          `json:",omitempty"` // udp, udp4, udp6, tcp, tcp4 or tcp6. Blank == udp
+	ID         string          `json:",omitempty"`
+	Result     svipul.ResolveM // Auto (default) = resolve based on input, OID = leave OIDs unresolved, Resolve = try to resolve
+	Set        []Varbind       `json:",omitempty"` // Values to write, Set mode only
+	From       string          `json:",omitempty"` // First index, GetRange mode only
+	To         string          `json:",omitempty"` // Last index, GetRange mode only
+	MaxTime    svipul.Duration `json:",omitempty"` // Deadline for the entire order, blank == MaxOrderTime
+	delivery   amqp.Delivery
+	received   time.Time
+	batch      *batch // Other orders from the same message, if any
+
+	svipul.Timing // Timeout, Retries, ExponentialTimeout, MaxOids, MaxRepetitions
 }
 
 func (o Order) String() string {
 	return o.Target
 }
 
-type ResolveM int
-
-const (
-	Auto ResolveM = iota
-	OID
-	Resolve
-)
+// GoString keeps the credentials of the order out of logs.
+func (o Order) GoString() string {
+	type plain Order
+	p := plain(o)
+	p.Community = svipul.Redact(p.Community)
+	return fmt.Sprintf("%#v", p)
+}
 
-func (r *ResolveM) UnmarshalJSON(b []byte) error {
-	var s string
-	if err := json.Unmarshal(b, &s); err != nil {
-		return err
-	}
-	s = strings.ToLower(s)
-	switch s {
-	case "auto":
-		*r = Auto
-	case "oid":
-		*r = OID
-	case "resolve":
-		*r = Resolve
-	default:
-		return fmt.Errorf("invalid resolver mode: %s", s)
+// deadline returns when the order has to be done, or the zero time if
+// there is no limit. The expiration of the message is counted from its
+// timestamp, if it has one that makes sense, since it may have been
+// waiting in the queue for a while.
+func (o Order) deadline() time.Time {
+	var deadline time.Time
+	max := o.MaxTime
+	if max == 0 {
+		max = svipul.Config.MaxOrderTime
+	}
+	if max > 0 {
+		deadline = o.received.Add(time.Duration(max))
+	}
+	if o.delivery.Expiration != "" {
+		ms, err := strconv.ParseInt(o.delivery.Expiration, 10, 64)
+		if err != nil || ms < 0 {
+			svipul.Logf("%s: ignoring invalid message expiration %q", o.Target, o.delivery.Expiration)
+			return deadline
+		}
+		published := o.received
+		if ts := o.delivery.Timestamp; !ts.IsZero() && ts.Before(published) {
+			published = ts
+		}
+		expires := published.Add(time.Duration(ms) * time.Millisecond)
+		if deadline.IsZero() || expires.Before(deadline) {
+			deadline = expires
+		}
 	}
-	return nil
+	return deadline
 }
 
-func (r ResolveM) MarshalJSON() ([]byte, error) {
-	switch r {
-	case Auto:
-		return []byte("\"Auto\""), nil
-	case OID:
-		return []byte("\"OID\""), nil
-	case Resolve:
-		return []byte("\"Resolve\""), nil
-	default:
-		return []byte("\"\""), fmt.Errorf("invalid resolve mode %d!", r)
+// context returns the context the order runs with.
+func (o Order) context() (context.Context, context.CancelFunc) {
+	deadline := o.deadline()
+	if deadline.IsZero() {
+		return context.WithCancel(context.Background())
 	}
+	return context.WithDeadline(context.Background(), deadline)
 }
 
-type Mode int
+// reloadOnHUP reloads the inventory and secrets every time we get a
+// SIGHUP.
+func reloadOnHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := inventory.Reload(); err != nil {
+			svipul.Logf("Inventory reload failed, keeping the old one: %s", err)
+		}
+		if err := inventory.ReloadSecrets(); err != nil {
+			svipul.Logf("Secrets reload failed, keeping the old ones: %s", err)
+		}
+		svipul.Logf("Reloaded on SIGHUP")
+	}
+}
 
-const (
-	Walk        Mode = iota // Do a walk
-	Get                     // Get just these oids
-	GetElements             // Get these specific oids, but per elements
-	BuildMap                // Build an OMap
-	ClearMap                // Clear the OMap cache
-)
+// lanes dispatches orders to the workers by target: orders for the same
+// target always go to the same worker, so they are carried out one at a
+// time, in the order they arrived, without fighting over the host lock.
+// Different targets are spread over the workers and run in parallel.
+//
+// The flip side is that a lane that falls behind holds up the dispatch of
+// orders for other lanes once its buffer is full.
+type lanes []chan Order
 
-func (m *Mode) UnmarshalJSON(b []byte) error {
-	var s string
-	if err := json.Unmarshal(b, &s); err != nil {
-		return err
-	}
-	s = strings.ToLower(s)
-	switch s {
-	case "walk":
-		*m = Walk
-	case "get":
-		*m = Get
-	case "getelements":
-		*m = GetElements
-	case "buildmap":
-		*m = BuildMap
-	case "clearmap":
-		*m = ClearMap
-	default:
-		return fmt.Errorf("invalid mode: %s", s)
+func newLanes(n int, buffer int) lanes {
+	l := make(lanes, n)
+	for i := range l {
+		l[i] = make(chan Order, buffer)
 	}
-	return nil
+	return l
 }
 
-func (m Mode) MarshalJSON() ([]byte, error) {
-	switch m {
-	case Walk:
-		return []byte("\"Walk\""), nil
-	case Get:
-		return []byte("\"Get\""), nil
-	case GetElements:
-		return []byte("\"GetElements\""), nil
-	case BuildMap:
-		return []byte("\"BuildMap\""), nil
-	case ClearMap:
-		return []byte("\"ClearMap\""), nil
-	default:
-		return []byte("\"\""), fmt.Errorf("invalid mode %d!", m)
-	}
+// dispatch queues the order on the lane of its target.
+func (l lanes) dispatch(o Order) {
+	h := fnv.New32a()
+	h.Write([]byte(o.Target))
+	l[h.Sum32()%uint32(len(l))] <- o
 }
 
 func (e *Engine) Listener(c chan Order, name string) {
 	svipul.Debugf("Starting listener %s...", name)
 	for order := range c {
 		now := time.Now()
-		err := e.Run(order)
+		ctx, cancel := order.context()
+		err := e.Run(ctx, order)
+		expired := err != nil && ctx.Err() != nil
+		if expired {
+			err = fmt.Errorf("order deadline exceeded: %w", err)
+		}
+		cancel()
 		since := time.Since(now).Round(time.Millisecond * 10)
 		if err != nil {
-			requeue := true
-			if order.delivery.Redelivered {
-				requeue = false
-			}
+			requeue := retry(order, err, expired)
 			svipul.Logf("[%2s]: %-15s FAIL %s: %s (requeue: %v)", name, order, since.String(), err, requeue)
+			e.Failed(order, err, classOf(err, expired), requeue)
 			if requeue {
 				delayR := rand.Int() % 10
 				d := time.Second*1 + time.Second*time.Duration(delayR)
 				svipul.Debugf("Sleeping %v before NACK/requeue", d)
 				time.Sleep(d)
 			}
-			err2 := order.delivery.Nack(false, requeue)
-			if err2 != nil {
-				svipul.Logf("NAck failed: %s", err2)
-			}
-
+			order.settle(false, requeue)
 		} else {
 			svipul.Logf("[%2s]: %-15s OK %s", name, order, since.String())
-			err2 := order.delivery.Ack(false)
-			if err2 != nil {
-				svipul.Logf("Ack failed: %s", err2)
-			}
+			order.settle(true, false)
 		}
 	}
 }
 
+// settle acknowledges the message of the order if it went ok, otherwise
+// rejects it, with requeue if asked to. If the message holds more orders,
+// it is settled by the last of them to finish, see batch.
+func (o Order) settle(ok bool, requeue bool) {
+	if o.batch != nil {
+		last, ack := o.batch.finish(ok)
+		if !last {
+			return
+		}
+		ok, requeue = ack, false
+	}
+	if ok {
+		if err := o.delivery.Ack(false); err != nil {
+			svipul.Logf("Ack failed: %s", err)
+		}
+		return
+	}
+	if err := o.delivery.Nack(false, requeue); err != nil {
+		svipul.Logf("NAck failed: %s", err)
+	}
+}
+
 func main() {
 	var configFile string
 	flag.BoolVar(&svipul.Config.Debug, "debug", false, "enable debug")
@@ -514,8 +739,29 @@ func main() {
 	if err != nil {
 		svipul.Fatalf("Couldn't initialize engine: %s", err)
 	}
-	c := make(chan Order, 0)
-	for i := 0; i < svipul.Config.Workers; i++ {
+	if svipul.Config.Workers < 1 {
+		svipul.Fatalf("Need at least one worker")
+	}
+	if svipul.Config.Inventory != "" {
+		if err := inventory.Load(svipul.Config.Inventory); err != nil {
+			svipul.Fatalf("Couldn't load inventory: %s", err)
+		}
+		svipul.Logf("Loaded inventory from %s", svipul.Config.Inventory)
+		if svipul.Config.InventoryPoll > 0 {
+			go inventory.Watch(time.Duration(svipul.Config.InventoryPoll))
+		}
+	}
+	if svipul.Config.Secrets != "" {
+		if err := inventory.LoadSecrets(svipul.Config.Secrets); err != nil {
+			svipul.Fatalf("Couldn't load secrets: %s", err)
+		}
+		svipul.Logf("Loaded secrets from %s", svipul.Config.Secrets)
+	}
+	if svipul.Config.Inventory != "" || svipul.Config.Secrets != "" {
+		go reloadOnHUP()
+	}
+	l := newLanes(svipul.Config.Workers, svipul.Config.LaneBuffer)
+	for i, c := range l {
 		go e.Listener(c, fmt.Sprintf("%d", i))
 		time.Sleep(time.Microsecond * 20)
 	}
@@ -536,7 +782,13 @@ func main() {
 		svipul.Fatalf("can't get channel: %s", err)
 	}
 	defer ch.Close()
-	err = ch.Qos(svipul.Config.Workers+1, 0, true)
+	e.replies, err = conn.Channel()
+	if err != nil {
+		svipul.Fatalf("can't get reply channel: %s", err)
+	}
+	defer e.replies.Close()
+	// Enough to keep every lane busy and its buffer full
+	err = ch.Qos(svipul.Config.Workers*(svipul.Config.LaneBuffer+1)+1, 0, true)
 	if err != nil {
 		svipul.Fatalf("can't set qos: %s", err)
 	}
@@ -567,15 +819,18 @@ func main() {
 	}
 	svipul.Logf("Listening for orders")
 	for d := range msgs {
-		order := Order{}
-		err = json.Unmarshal(d.Body, &order)
+		orders, err := parseOrders(d.Body)
 		if err != nil {
-			svipul.Logf("order json unmarshal: %s", err)
+			svipul.Logf("invalid order: %s", err)
 			d.Reject(false)
 			continue
 		}
-		order.delivery = d
-		c <- order
+		now := time.Now()
+		for _, order := range orders {
+			order.delivery = d
+			order.received = now
+			l.dispatch(order)
+		}
 	}
 	svipul.Logf("Reached the end. Connection probably dead. Some day, we'll handle this, but not today.")
 }
@@ -0,0 +1,171 @@
+/*
+ * svipul-snmp tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/telenornms/skogul"
+	sconfig "github.com/telenornms/skogul/config"
+	"github.com/telenornms/svipul"
+	"github.com/telenornms/svipul/inventory"
+	"github.com/telenornms/svipul/session"
+)
+
+func TestSetMissing(t *testing.T) {
+	task := Task{Result: svipul.OID}
+	task.Metric.Metadata = map[string]interface{}{"target": "router1"}
+	task.setMissing(nil)
+	if _, ok := task.Metric.Metadata["missing"]; ok {
+		t.Errorf("missing set without anything missing")
+	}
+	task.setMissing(map[string]string{
+		".1.3.6.1.2.1.2.2.1.4":  "empty",
+		".1.3.6.1.2.1.2.2.1.99": "noSuchObject",
+	})
+	m, ok := task.Metric.Metadata["missing"].(map[string]interface{})
+	if !ok || len(m) != 2 || m[".1.3.6.1.2.1.2.2.1.4"] != "empty" || m[".1.3.6.1.2.1.2.2.1.99"] != "noSuchObject" {
+		t.Errorf("unexpected missing metadata: %v", task.Metric.Metadata["missing"])
+	}
+	if task.Metric.Metadata["target"] != "router1" {
+		t.Errorf("other metadata lost: %v", task.Metric.Metadata)
+	}
+}
+
+func TestLanes(t *testing.T) {
+	l := newLanes(4, 100)
+	targets := []string{"router1", "router2", "switch1", "switch2", "192.0.2.1", "192.0.2.2", "[2001:db8::1]:161", "firewall"}
+	for i := 0; i < 5; i++ {
+		for _, target := range targets {
+			l.dispatch(Order{Target: target, ID: fmt.Sprintf("%s/%d", target, i)})
+		}
+	}
+	lane := make(map[string]int)
+	next := make(map[string]int)
+	used := 0
+	for n, c := range l {
+		if len(c) > 0 {
+			used++
+		}
+		for len(c) > 0 {
+			o := <-c
+			if seen, ok := lane[o.Target]; ok && seen != n {
+				t.Errorf("orders for %s on both lane %d and %d", o.Target, seen, n)
+			}
+			lane[o.Target] = n
+			if want := fmt.Sprintf("%s/%d", o.Target, next[o.Target]); o.ID != want {
+				t.Errorf("lane %d: expected %s, got %s", n, want, o.ID)
+			}
+			next[o.Target]++
+		}
+	}
+	for _, target := range targets {
+		if next[target] != 5 {
+			t.Errorf("expected 5 orders for %s, got %d", target, next[target])
+		}
+	}
+	if used < len(l) {
+		t.Errorf("%d targets all dispatched to %d lane(s)", len(targets), used)
+	}
+}
+
+// recorder is a skogul sender keeping what it is sent.
+type recorder struct {
+	metrics []*skogul.Metric
+}
+
+func (r *recorder) Send(c *skogul.Container) error {
+	r.metrics = append(r.metrics, c.Metrics...)
+	return nil
+}
+
+func TestBreakerAddress(t *testing.T) {
+	defer func(timeouts int) {
+		svipul.Config.BreakerTimeouts = timeouts
+	}(svipul.Config.BreakerTimeouts)
+	svipul.Config.BreakerTimeouts = 1
+
+	// An agent that never answers, known by another name in the inventory
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to start agent: %v", err)
+	}
+	defer conn.Close()
+	addr := conn.LocalAddr().String()
+	defer session.ClearBreaker(addr)
+	f := filepath.Join(t.TempDir(), "hosts.toml")
+	inv := fmt.Sprintf("[Hosts.router1]\nAddress = %q\nTimeout = \"100ms\"\nRetries = 0\n", addr)
+	if err := os.WriteFile(f, []byte(inv), 0600); err != nil {
+		t.Fatalf("unable to write inventory: %v", err)
+	}
+	if err := inventory.Load(f); err != nil {
+		t.Fatalf("unable to load inventory: %v", err)
+	}
+	defer inventory.Unload()
+
+	host, err := inventory.LockHost(context.Background(), "router1")
+	if err != nil {
+		t.Fatalf("unable to lock host: %v", err)
+	}
+	sess, err := session.NewSession(host)
+	if err != nil {
+		t.Fatalf("session creation failed: %v", err)
+	}
+	nodes := []svipul.Node{{Numeric: "1.3.6.1.2.1.1.5", Qualified: "1.3.6.1.2.1.1.5.0"}}
+	sess.Get(context.Background(), nodes, func(pdu gosnmp.SnmpPDU) error { return nil })
+	sess.Finalize()
+	host.Unlock()
+
+	r := &recorder{}
+	e := Engine{Skogul: &sconfig.Config{Handlers: map[string]*sconfig.Handler{
+		"svipul": {Handler: skogul.Handler{Sender: r}},
+	}}}
+	if err := e.Breaker(Order{Target: "router1", Mode: svipul.Breaker}); err != nil {
+		t.Fatalf("breaker order failed: %v", err)
+	}
+	if err := e.Breaker(Order{Target: "router1", Mode: svipul.ClearBreaker}); err != nil {
+		t.Fatalf("clear breaker order failed: %v", err)
+	}
+	if len(r.metrics) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(r.metrics))
+	}
+	if state := r.metrics[0].Data["State"]; state != session.Open {
+		t.Errorf("expected the breaker of router1 to be open, got %v", state)
+	}
+	if target := r.metrics[0].Metadata["target"]; target != "router1" {
+		t.Errorf("expected target router1, got %v", target)
+	}
+	if state := r.metrics[1].Data["State"]; state != session.Closed {
+		t.Errorf("expected the cleared breaker to be closed, got %v", state)
+	}
+	if state := session.Breaker(addr); state.State != session.Closed {
+		t.Errorf("breaker of %s not cleared: %+v", addr, state)
+	}
+}
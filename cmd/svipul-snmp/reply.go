@@ -0,0 +1,88 @@
+/*
+ * svipul request/reply
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/telenornms/skogul"
+	"github.com/telenornms/svipul"
+)
+
+// replyBody returns the body of the reply to o, or nil if o has no reply
+// queue. It must be called before the container is sent on through
+// skogul, since the transformers may change it.
+func replyBody(o Order, c *skogul.Container) []byte {
+	if o.delivery.ReplyTo == "" {
+		return nil
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		svipul.Logf("%s: unable to encode reply: %s", o.Target, err)
+		return nil
+	}
+	return b
+}
+
+// reply publishes body to the reply queue of o, with the correlation ID
+// of o, if it asked for a reply. Results and error results are published
+// as the same JSON containers skogul gets, untransformed. Failing to reply
+// is only logged, the order itself went fine.
+//
+// Orders from the same message share the correlation ID, so if there is
+// more than one, the "parts" header tells how many final replies to
+// expect.
+func (e *Engine) reply(o Order, body []byte) {
+	if body == nil || e.replies == nil {
+		return
+	}
+	var headers amqp.Table
+	if o.batch != nil {
+		headers = amqp.Table{"parts": int32(o.batch.parts)}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	e.replyLock.Lock()
+	defer e.replyLock.Unlock()
+	err := e.replies.PublishWithContext(ctx, "", o.delivery.ReplyTo, false, false, amqp.Publishing{
+		ContentType:   "application/json",
+		CorrelationId: o.delivery.CorrelationId,
+		Headers:       headers,
+		Timestamp:     time.Now(),
+		Body:          body,
+	})
+	if err != nil {
+		svipul.Logf("%s: unable to publish reply to %s: %s", o.Target, o.delivery.ReplyTo, err)
+	}
+}
+
+// done replies to orders that don't have results of their own, like
+// ClearMap, with an empty container, so callers waiting for a reply know
+// it's done.
+func (e *Engine) done(o Order) {
+	e.reply(o, replyBody(o, &skogul.Container{Metrics: []*skogul.Metric{}}))
+}
@@ -0,0 +1,44 @@
+/*
+ * svipul request/reply tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/telenornms/skogul"
+)
+
+func TestReplyBody(t *testing.T) {
+	c := &skogul.Container{Metrics: []*skogul.Metric{{Metadata: map[string]interface{}{"target": "router1"}}}}
+	if b := replyBody(Order{}, c); b != nil {
+		t.Errorf("reply body for order without ReplyTo: %s", b)
+	}
+	b := replyBody(Order{delivery: amqp.Delivery{ReplyTo: "amq.gen-1"}}, c)
+	var got skogul.Container
+	if err := json.Unmarshal(b, &got); err != nil || len(got.Metrics) != 1 || got.Metrics[0].Metadata["target"] != "router1" {
+		t.Errorf("unexpected reply body %s (%v)", b, err)
+	}
+}
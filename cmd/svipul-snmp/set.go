@@ -0,0 +1,285 @@
+/*
+ * svipul SNMP set mode
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/sleepinggenius2/gosmi/models"
+	"github.com/sleepinggenius2/gosmi/types"
+	"github.com/telenornms/skogul"
+	"github.com/telenornms/svipul"
+	"github.com/telenornms/svipul/session"
+	"github.com/telenornms/svipul/smierte"
+)
+
+// Varbind is a single value to write in Set mode. Oid is either numeric or
+// a symbolic name, and must include the instance, e.g. "ifAlias.3". Type
+// is optional and is derived from the MIB, but if it is provided it has to
+// match. Value is a number or a string, depending on the type. Enums
+// accept both the number and the name, e.g. 2 or "down".
+type Varbind struct {
+	Oid   string
+	Type  string `json:",omitempty"` // Integer, Gauge32, Counter32, TimeTicks, OctetString, IpAddress or ObjectIdentifier
+	Value interface{}
+}
+
+// setAllowed checks if the target is in the set allow-list. Entries are
+// either exact target names or CIDR prefixes, which only match targets
+// given as IP addresses.
+func setAllowed(target string) bool {
+	if !svipul.Config.AllowSet {
+		return false
+	}
+	host := target
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	ip := net.ParseIP(host)
+	for _, a := range svipul.Config.SetTargets {
+		if a == target || a == host {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(a); err == nil && ip != nil && cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// snmpType maps a MIB type to the SNMP type used on the wire.
+func snmpType(t *models.Type) (gosnmp.Asn1BER, error) {
+	switch t.BaseType {
+	case types.BaseTypeInteger32, types.BaseTypeEnum:
+		return gosnmp.Integer, nil
+	case types.BaseTypeUnsigned32:
+		switch t.Name {
+		case "TimeTicks", "TimeStamp", "TimeInterval":
+			return gosnmp.TimeTicks, nil
+		case "Counter32":
+			return gosnmp.Counter32, nil
+		default:
+			return gosnmp.Gauge32, nil
+		}
+	case types.BaseTypeOctetString:
+		if t.Name == "IpAddress" {
+			return gosnmp.IPAddress, nil
+		}
+		return gosnmp.OctetString, nil
+	case types.BaseTypeObjectIdentifier:
+		return gosnmp.ObjectIdentifier, nil
+	default:
+		return gosnmp.UnknownType, fmt.Errorf("setting values of type %s is not supported", t.BaseType)
+	}
+}
+
+var typeNames = map[string]gosnmp.Asn1BER{
+	"integer":          gosnmp.Integer,
+	"integer32":        gosnmp.Integer,
+	"gauge32":          gosnmp.Gauge32,
+	"unsigned32":       gosnmp.Gauge32,
+	"counter32":        gosnmp.Counter32,
+	"timeticks":        gosnmp.TimeTicks,
+	"octetstring":      gosnmp.OctetString,
+	"ipaddress":        gosnmp.IPAddress,
+	"objectidentifier": gosnmp.ObjectIdentifier,
+}
+
+// buildPDU validates a varbind against the MIB and converts it to a PDU.
+// The object has to be known, writable (read-write or read-create) and
+// the value has to fit the type, including range and size restrictions.
+func buildPDU(v Varbind) (gosnmp.SnmpPDU, error) {
+	pdu := gosnmp.SnmpPDU{}
+	node, err := smierte.Lookup(v.Oid)
+	if err != nil {
+		return pdu, classify(Lookup, fmt.Errorf("unable to look up %s: %w", v.Oid, err))
+	}
+	if node.Type == nil {
+		return pdu, fmt.Errorf("%s has no known type, refusing to set it", v.Oid)
+	}
+	if node.Access != types.AccessReadWrite {
+		return pdu, fmt.Errorf("%s is not writable (access: %s)", v.Oid, node.Access)
+	}
+	if node.Qualified == node.Numeric {
+		return pdu, fmt.Errorf("%s has no instance, e.g. %s.0 or %s.1", v.Oid, v.Oid, v.Oid)
+	}
+	pdu.Name = "." + node.Qualified
+	pdu.Type, err = snmpType(node.Type)
+	if err != nil {
+		return pdu, fmt.Errorf("%s: %w", v.Oid, err)
+	}
+	if v.Type != "" {
+		want, ok := typeNames[strings.ToLower(v.Type)]
+		if !ok {
+			return pdu, fmt.Errorf("%s: unknown type %s", v.Oid, v.Type)
+		}
+		if want != pdu.Type {
+			return pdu, fmt.Errorf("%s: type %s does not match MIB type %s", v.Oid, v.Type, pdu.Type)
+		}
+	}
+	switch pdu.Type {
+	case gosnmp.Integer:
+		var i int64
+		if s, ok := v.Value.(string); ok && node.Type.Enum != nil {
+			i, err = node.Type.Enum.Value(s)
+			if err != nil {
+				return pdu, fmt.Errorf("%s: %w", v.Oid, err)
+			}
+		} else {
+			i, err = number(v.Value, math.MinInt32, math.MaxInt32)
+			if err != nil {
+				return pdu, fmt.Errorf("%s: %w", v.Oid, err)
+			}
+			if node.Type.Enum != nil && !isEnum(node.Type.Enum, i) {
+				return pdu, fmt.Errorf("%s: %d is not a valid enum value", v.Oid, i)
+			}
+		}
+		if err := inRange(node, i); err != nil {
+			return pdu, err
+		}
+		pdu.Value = int(i)
+	case gosnmp.Gauge32, gosnmp.Counter32, gosnmp.TimeTicks:
+		i, err := number(v.Value, 0, math.MaxUint32)
+		if err != nil {
+			return pdu, fmt.Errorf("%s: %w", v.Oid, err)
+		}
+		if err := inRange(node, i); err != nil {
+			return pdu, err
+		}
+		pdu.Value = uint32(i)
+	case gosnmp.OctetString:
+		s, ok := v.Value.(string)
+		if !ok {
+			return pdu, fmt.Errorf("%s: expected a string value, got %T", v.Oid, v.Value)
+		}
+		if err := inRange(node, int64(len(s))); err != nil {
+			return pdu, err
+		}
+		pdu.Value = s
+	case gosnmp.IPAddress:
+		s, ok := v.Value.(string)
+		if !ok || net.ParseIP(s) == nil || net.ParseIP(s).To4() == nil {
+			return pdu, fmt.Errorf("%s: expected an IPv4 address, got %v", v.Oid, v.Value)
+		}
+		pdu.Value = s
+	case gosnmp.ObjectIdentifier:
+		s, ok := v.Value.(string)
+		if !ok {
+			return pdu, fmt.Errorf("%s: expected an OID, got %T", v.Oid, v.Value)
+		}
+		oid, err := smierte.Lookup(s)
+		if err != nil {
+			return pdu, classify(Lookup, fmt.Errorf("%s: unable to look up value %s: %w", v.Oid, s, err))
+		}
+		pdu.Value = "." + oid.Qualified
+	}
+	return pdu, nil
+}
+
+// isEnum returns true if i is one of the values of e. Enum.Name can't
+// tell, since it returns "unknown" for values that aren't, which is also
+// a common label.
+func isEnum(e *models.Enum, i int64) bool {
+	for _, v := range e.Values {
+		if v.Value == i {
+			return true
+		}
+	}
+	return false
+}
+
+// number converts a JSON number to an integer within bounds.
+func number(v interface{}, min int64, max int64) (int64, error) {
+	f, ok := v.(float64)
+	if !ok {
+		return 0, fmt.Errorf("expected a number, got %T", v)
+	}
+	if f != math.Trunc(f) {
+		return 0, fmt.Errorf("expected an integer, got %v", f)
+	}
+	if f < float64(min) || f > float64(max) {
+		return 0, fmt.Errorf("value %v out of bounds (%d - %d)", f, min, max)
+	}
+	return int64(f), nil
+}
+
+// inRange checks the value (or size, for strings) against the ranges of
+// the MIB type, if there are any.
+func inRange(node svipul.Node, i int64) error {
+	if len(node.Type.Ranges) == 0 {
+		return nil
+	}
+	for _, r := range node.Type.Ranges {
+		if i >= r.MinValue && i <= r.MaxValue {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: %d is outside the allowed range(s) of %s", node.Key, i, node.Type.Name)
+}
+
+// Set carries out a Set order. All varbinds are validated before anything
+// is sent, and the result echoes both what was written (in the "set"
+// metadata) and the agent's response (as data).
+func (e *Engine) Set(ctx context.Context, o Order, sess *session.Session) error {
+	pdus := make([]gosnmp.SnmpPDU, 0, len(o.Set))
+	written := make(map[string]interface{})
+	for _, v := range o.Set {
+		pdu, err := buildPDU(v)
+		if err != nil {
+			return fmt.Errorf("invalid set: %w", err)
+		}
+		pdus = append(pdus, pdu)
+		written[v.Oid] = v.Value
+	}
+	t := Task{Result: o.Result}
+	if t.Result == svipul.Auto {
+		t.Result = svipul.OID
+		for _, v := range o.Set {
+			if n, _ := smierte.Lookup(v.Oid); n.Lookedup {
+				t.Result = svipul.Resolve
+			}
+		}
+	}
+	t.Metric.Metadata = make(map[string]interface{})
+	t.Metric.Metadata["target"] = o.Target
+	if o.ID != "" {
+		t.Metric.Metadata["id"] = o.ID
+	}
+	t.Metric.Metadata["set"] = written
+	t.Metric.Data = make(map[string]interface{})
+	svipul.Logf("%s: setting %d varbinds", o.Target, len(pdus))
+	err := sess.Set(ctx, pdus, t.bwCB)
+	if err != nil {
+		return fmt.Errorf("snmp set failed: %w", err)
+	}
+	c := skogul.Container{}
+	c.Metrics = append(c.Metrics, &t.Metric)
+	return e.send(o, &c)
+}
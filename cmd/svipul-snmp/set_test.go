@@ -0,0 +1,163 @@
+/*
+ * svipul-snmp set tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/telenornms/svipul"
+	"github.com/telenornms/svipul/smierte"
+)
+
+func TestSetAllowed(t *testing.T) {
+	defer func(allow bool, targets []string) {
+		svipul.Config.AllowSet = allow
+		svipul.Config.SetTargets = targets
+	}(svipul.Config.AllowSet, svipul.Config.SetTargets)
+	svipul.Config.SetTargets = []string{"lab-switch-1", "192.0.2.0/24", "2001:db8::/32"}
+
+	svipul.Config.AllowSet = false
+	if setAllowed("lab-switch-1") || setAllowed("192.0.2.1") {
+		t.Errorf("set allowed with AllowSet=false")
+	}
+
+	svipul.Config.AllowSet = true
+	cases := []struct {
+		target  string
+		allowed bool
+	}{
+		{"lab-switch-1", true},
+		{"lab-switch-1:1161", true},
+		{"lab-switch-2", false},
+		{"192.0.2.10", true},
+		{"192.0.2.10:1161", true},
+		{"192.0.3.10", false},
+		{"2001:db8::1", true},
+		{"[2001:db8::1]:1161", true},
+		{"2001:db9::1", false},
+		{"192.0.2.0/24", true}, // Listed as is
+		{"router.192.0.2.10.example.com", false},
+	}
+	for _, c := range cases {
+		if got := setAllowed(c.target); got != c.allowed {
+			t.Errorf("setAllowed(%s): expected %v, got %v", c.target, c.allowed, got)
+		}
+	}
+}
+
+func TestNumber(t *testing.T) {
+	cases := []struct {
+		v     interface{}
+		ok    bool
+		value int64
+	}{
+		{float64(5), true, 5},
+		{float64(-5), true, -5},
+		{float64(5.5), false, 0},
+		{float64(11), false, 0},
+		{float64(-11), false, 0},
+		{"5", false, 0},
+		{nil, false, 0},
+	}
+	for _, c := range cases {
+		i, err := number(c.v, -10, 10)
+		if (err == nil) != c.ok || i != c.value {
+			t.Errorf("number(%#v): expected %d, ok %v, got %d, %v", c.v, c.value, c.ok, i, err)
+		}
+	}
+}
+
+func TestBuildPDU(t *testing.T) {
+	defer func(paths []string) { svipul.Config.MibPaths = paths }(svipul.Config.MibPaths)
+	svipul.Config.MibPaths = []string{"../../mibs/modules"}
+	if err := smierte.Init(svipul.Config.MibModules, svipul.Config.MibPaths); err != nil {
+		t.Fatalf("failed to load MIBs: %v", err)
+	}
+	cases := []struct {
+		v     Varbind
+		name  string
+		typ   gosnmp.Asn1BER
+		value interface{}
+	}{
+		{Varbind{Oid: "sysName.0", Value: "lab-switch-1"}, ".1.3.6.1.2.1.1.5.0", gosnmp.OctetString, "lab-switch-1"},
+		{Varbind{Oid: "sysName.0", Type: "OctetString", Value: "lab-switch-1"}, ".1.3.6.1.2.1.1.5.0", gosnmp.OctetString, "lab-switch-1"},
+		{Varbind{Oid: ".1.3.6.1.2.1.1.5.0", Value: ""}, ".1.3.6.1.2.1.1.5.0", gosnmp.OctetString, ""},
+		{Varbind{Oid: "ifAdminStatus.3", Value: "down"}, ".1.3.6.1.2.1.2.2.1.7.3", gosnmp.Integer, 2},
+		{Varbind{Oid: "ifAdminStatus.3", Value: float64(2)}, ".1.3.6.1.2.1.2.2.1.7.3", gosnmp.Integer, 2},
+		{Varbind{Oid: "entStateAdmin.1", Value: "unknown"}, ".1.3.6.1.2.1.131.1.1.1.2.1", gosnmp.Integer, 1},
+		{Varbind{Oid: "entStateAdmin.1", Value: float64(1)}, ".1.3.6.1.2.1.131.1.1.1.2.1", gosnmp.Integer, 1},
+		{Varbind{Oid: "snmpSetSerialNo.0", Value: float64(2147483647)}, ".1.3.6.1.6.3.1.1.6.1.0", gosnmp.Gauge32, uint32(2147483647)},
+		{Varbind{Oid: "ifTestType.1", Value: "sysName"}, ".1.3.6.1.2.1.31.1.3.1.3.1", gosnmp.ObjectIdentifier, ".1.3.6.1.2.1.1.5"},
+		{Varbind{Oid: "ifTestType.1", Value: ".1.3.6.1.2.1.1.5.0"}, ".1.3.6.1.2.1.31.1.3.1.3.1", gosnmp.ObjectIdentifier, ".1.3.6.1.2.1.1.5.0"},
+	}
+	for _, c := range cases {
+		pdu, err := buildPDU(c.v)
+		if err != nil {
+			t.Errorf("%+v: %v", c.v, err)
+			continue
+		}
+		if pdu.Name != c.name || pdu.Type != c.typ || pdu.Value != c.value {
+			t.Errorf("%+v: expected %s %s %#v, got %s %s %#v", c.v, c.name, c.typ, c.value, pdu.Name, pdu.Type, pdu.Value)
+		}
+	}
+
+	long := make([]byte, 256)
+	for i := range long {
+		long[i] = 'x'
+	}
+	invalid := []struct {
+		v      Varbind
+		lookup bool // Expected to be classified as a lookup error
+	}{
+		{Varbind{Oid: "sysDescr.0", Value: "read-only"}, false},                // Read-only
+		{Varbind{Oid: "sysORID.1", Value: "sysName"}, false},                   // Read-only
+		{Varbind{Oid: "sysName", Value: "no instance"}, false},                 // No instance
+		{Varbind{Oid: "noSuchThing.0", Value: "x"}, true},                      // Unknown object
+		{Varbind{Oid: "sysName.0", Value: float64(1)}, false},                  // Number for a string
+		{Varbind{Oid: "sysName.0", Type: "Integer", Value: "x"}, false},        // Type mismatch
+		{Varbind{Oid: "sysName.0", Type: "Bogus", Value: "x"}, false},          // Unknown type
+		{Varbind{Oid: "sysName.0", Value: string(long)}, false},                // Too long
+		{Varbind{Oid: "ifAdminStatus.3", Value: "sideways"}, false},            // Unknown enum name
+		{Varbind{Oid: "ifAdminStatus.3", Value: float64(7)}, false},            // Unknown enum value
+		{Varbind{Oid: "entStateAdmin.1", Value: float64(5)}, false},            // Unknown enum value
+		{Varbind{Oid: "ifAdminStatus.3", Value: float64(1.5)}, false},          // Not an integer
+		{Varbind{Oid: "snmpSetSerialNo.0", Value: float64(2147483648)}, false}, // Outside the MIB range
+		{Varbind{Oid: "snmpSetSerialNo.0", Value: float64(-1)}, false},         // Outside the type
+		{Varbind{Oid: "ifTestType.1", Value: float64(1)}, false},               // Number for an OID
+		{Varbind{Oid: "ifTestType.1", Value: "noSuchThing"}, true},             // Unknown OID value
+	}
+	for _, c := range invalid {
+		pdu, err := buildPDU(c.v)
+		if err == nil {
+			t.Errorf("%+v: expected an error, got %+v", c.v, pdu)
+			continue
+		}
+		var cl classified
+		if isLookup := errors.As(err, &cl) && cl.class == Lookup; isLookup != c.lookup {
+			t.Errorf("%+v: expected lookup error %v, got %v", c.v, c.lookup, err)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+/*
+ * svipul trap receiver
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/telenornms/skogul"
+	sconfig "github.com/telenornms/skogul/config"
+	"github.com/telenornms/svipul"
+	"github.com/telenornms/svipul/session"
+	"github.com/telenornms/svipul/smierte"
+)
+
+const (
+	snmpTrapOID       = ".1.3.6.1.6.3.1.1.4.1.0"
+	snmpTraps         = ".1.3.6.1.6.3.1.1.5"
+	sysUpTimeInstance = ".1.3.6.1.2.1.1.3.0"
+)
+
+// Receiver receives traps and informs and sends them on through skogul,
+// one metric per trap.
+type Receiver struct {
+	Skogul *sconfig.Config // output
+
+	engineID    string // Our engine ID, for v3 informs
+	boot        time.Time
+	communities map[string]bool
+	users       map[string]svipul.V3
+	plain       *gosnmp.GoSNMP // decoder for v1 and v2c
+
+	lock             sync.Mutex
+	decoders         map[string]*gosnmp.GoSNMP // v3 decoders, see decoder()
+	unknownEngineIDs uint32
+}
+
+// Init reads the skogul configuration, loads MIBs and sets up the
+// communities and users we accept.
+func (r *Receiver) Init(sc string) error {
+	var err error
+	r.Skogul, err = sconfig.Path(sc)
+	if err != nil {
+		return fmt.Errorf("skogul-config failed loading: %w", err)
+	}
+	if r.Skogul.Handlers[svipul.Config.TrapHandler] == nil {
+		return fmt.Errorf("missing %s handler in skogul config", svipul.Config.TrapHandler)
+	}
+	err = smierte.Init(svipul.Config.MibModules, svipul.Config.MibPaths)
+	if err != nil {
+		return fmt.Errorf("failed to load mibs: %w", err)
+	}
+	return r.setup()
+}
+
+// setup prepares everything but the output and MIBs.
+func (r *Receiver) setup() error {
+	r.boot = time.Now()
+	r.plain = &gosnmp.GoSNMP{}
+	r.decoders = make(map[string]*gosnmp.GoSNMP)
+	r.communities = make(map[string]bool)
+	for _, c := range svipul.Config.TrapCommunities {
+		r.communities[c] = true
+	}
+	r.users = make(map[string]svipul.V3)
+	for _, u := range svipul.Config.TrapUsers {
+		if _, _, err := session.USM(&u); err != nil {
+			return fmt.Errorf("invalid trap user %q: %w", u.Username, err)
+		}
+		r.users[u.Username] = u
+	}
+	if svipul.Config.TrapEngineID != "" {
+		id, err := hex.DecodeString(strings.TrimPrefix(svipul.Config.TrapEngineID, "0x"))
+		if err != nil {
+			return fmt.Errorf("invalid TrapEngineID: %w", err)
+		}
+		if len(id) < 5 || len(id) > 32 {
+			return fmt.Errorf("invalid TrapEngineID: must be 5 to 32 bytes, got %d", len(id))
+		}
+		r.engineID = string(id)
+	}
+	return nil
+}
+
+// Listen receives traps on conn until it fails.
+func (r *Receiver) Listen(conn *net.UDPConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return fmt.Errorf("read failed: %w", err)
+		}
+		// Decoded values may refer to the message, and skogul
+		// might hang on to the metric after we're done with it.
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
+		err = r.handle(conn, msg, remote)
+		if err != nil {
+			svipul.Logf("%s: %s", remote.IP, err)
+		}
+	}
+}
+
+// handle takes care of a single message. Informs are only acknowledged
+// once the trap has been passed on, so the sender will retransmit if we
+// fail to deliver it.
+func (r *Receiver) handle(conn *net.UDPConn, msg []byte, remote *net.UDPAddr) error {
+	pkt, err := r.decode(conn, msg, remote)
+	if err != nil || pkt == nil {
+		return err
+	}
+	m := r.metric(pkt, remote)
+	c := skogul.Container{}
+	c.Metrics = append(c.Metrics, m)
+	err = r.Skogul.Handlers[svipul.Config.TrapHandler].Handler.TransformAndSend(&c)
+	if err != nil {
+		return fmt.Errorf("send failed: %w", err)
+	}
+	if pkt.PDUType == gosnmp.InformRequest {
+		pkt.PDUType = gosnmp.GetResponse
+		pkt.MsgFlags &= gosnmp.AuthPriv
+		pkt.Error = gosnmp.NoError
+		pkt.ErrorIndex = 0
+		return r.send(conn, pkt, remote)
+	}
+	return nil
+}
+
+// decode decodes and authenticates a message, returning nil if it's not
+// a trap or inform, or has already been dealt with.
+func (r *Receiver) decode(conn *net.UDPConn, msg []byte, remote *net.UDPAddr) (*gosnmp.SnmpPacket, error) {
+	h, err := peek(msg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message: %w", err)
+	}
+	var pkt *gosnmp.SnmpPacket
+	if h.version == gosnmp.Version3 {
+		if h.engineID == "" {
+			return nil, r.report(conn, msg, h, remote)
+		}
+		pkt, err = r.decodeV3(msg, h)
+	} else {
+		pkt, err = r.plain.UnmarshalTrap(msg, false)
+		if err == nil && len(r.communities) > 0 && !r.communities[pkt.Community] {
+			err = fmt.Errorf("unknown community")
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dropping message: %w", err)
+	}
+	switch pkt.PDUType {
+	case gosnmp.Trap, gosnmp.SNMPv2Trap, gosnmp.InformRequest:
+		return pkt, nil
+	default:
+		svipul.Debugf("%s: ignoring PDU type %#x", remote.IP, pkt.PDUType)
+		return nil, nil
+	}
+}
+
+// send sends a response or report back to the sender.
+func (r *Receiver) send(conn *net.UDPConn, pkt *gosnmp.SnmpPacket, remote *net.UDPAddr) error {
+	b, err := pkt.MarshalMsg()
+	if err != nil {
+		return fmt.Errorf("unable to encode reply: %w", err)
+	}
+	_, err = conn.WriteToUDP(b, remote)
+	if err != nil {
+		return fmt.Errorf("unable to send reply: %w", err)
+	}
+	return nil
+}
+
+// v1TrapOID maps SNMPv1 trap fields to the equivalent snmpTrapOID, as
+// described in RFC 3584.
+func v1TrapOID(t gosnmp.SnmpTrap) string {
+	if t.GenericTrap >= 0 && t.GenericTrap < 6 {
+		return fmt.Sprintf("%s.%d", snmpTraps, t.GenericTrap+1)
+	}
+	enterprise := t.Enterprise
+	if !strings.HasPrefix(enterprise, ".") {
+		enterprise = "." + enterprise
+	}
+	return fmt.Sprintf("%s.0.%d", enterprise, t.SpecificTrap)
+}
+
+func versionName(v gosnmp.SnmpVersion) string {
+	switch v {
+	case gosnmp.Version1:
+		return "1"
+	case gosnmp.Version2c:
+		return "2c"
+	default:
+		return "3"
+	}
+}
+
+// metric converts a trap to a metric. The metadata identifies the trap
+// and where it came from, while the data holds the varbinds, keyed by
+// name and instance, e.g. "ifOperStatus.3". Values are rendered the same
+// way as for svipul-snmp.
+func (r *Receiver) metric(pkt *gosnmp.SnmpPacket, remote *net.UDPAddr) *skogul.Metric {
+	now := time.Now()
+	m := skogul.Metric{Time: &now}
+	m.Metadata = make(map[string]interface{})
+	m.Data = make(map[string]interface{})
+	m.Metadata["source"] = remote.IP.String()
+	m.Metadata["version"] = versionName(pkt.Version)
+	m.Metadata["type"] = "trap"
+	if pkt.PDUType == gosnmp.InformRequest {
+		m.Metadata["type"] = "inform"
+	}
+	if usm, ok := pkt.SecurityParameters.(*gosnmp.UsmSecurityParameters); ok && pkt.Version == gosnmp.Version3 {
+		m.Metadata["user"] = usm.UserName
+		if pkt.ContextName != "" {
+			m.Metadata["context"] = pkt.ContextName
+		}
+	}
+	trap := ""
+	if pkt.PDUType == gosnmp.Trap {
+		trap = v1TrapOID(pkt.SnmpTrap)
+		m.Metadata["enterprise"] = smierte.Name(pkt.Enterprise)
+		m.Metadata["agent"] = pkt.AgentAddress
+		m.Data[smierte.Name(sysUpTimeInstance)] = pkt.Timestamp
+	}
+	for _, pdu := range pkt.Variables {
+		if pdu.Name == snmpTrapOID {
+			if s, ok := pdu.Value.(string); ok {
+				trap = s
+			}
+			continue
+		}
+		m.Data[smierte.Name(pdu.Name)] = smierte.Value(pdu)
+	}
+	if trap != "" {
+		m.Metadata["trap"] = smierte.Name(trap)
+	}
+	return &m
+}
+
+func main() {
+	var configFile string
+	flag.BoolVar(&svipul.Config.Debug, "debug", false, "enable debug")
+	flag.StringVar(&configFile, "f", "/etc/svipul/trapd.toml", "trapd config file")
+	flag.Parse()
+	if err := svipul.ParseConfig(configFile); err != nil {
+		svipul.Fatalf("Couldn't parse config: %s", err)
+	}
+	svipul.Debugf("Read config file: %s", configFile)
+	svipul.Init()
+	r := Receiver{}
+	err := r.Init(svipul.Config.OutputConfig)
+	if err != nil {
+		svipul.Fatalf("Couldn't initialize receiver: %s", err)
+	}
+	if len(svipul.Config.TrapListen) == 0 {
+		svipul.Fatalf("No TrapListen addresses configured")
+	}
+	errs := make(chan error)
+	for _, addr := range svipul.Config.TrapListen {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			svipul.Fatalf("Can't resolve listen address %s: %s", addr, err)
+		}
+		conn, err := net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			svipul.Fatalf("Can't listen on %s: %s", addr, err)
+		}
+		defer conn.Close()
+		svipul.Logf("Listening for traps on %s", conn.LocalAddr())
+		go func(conn *net.UDPConn) {
+			errs <- r.Listen(conn)
+		}(conn)
+	}
+	err = <-errs
+	svipul.Fatalf("Listener failed: %s", err)
+}
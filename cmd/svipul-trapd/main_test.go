@@ -0,0 +1,135 @@
+/*
+ * svipul trap receiver tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/telenornms/svipul"
+	"github.com/telenornms/svipul/smierte"
+)
+
+var linkDown = []gosnmp.SnmpPDU{
+	{Name: sysUpTimeInstance, Type: gosnmp.TimeTicks, Value: uint32(1234)},
+	{Name: snmpTrapOID, Type: gosnmp.ObjectIdentifier, Value: ".1.3.6.1.6.3.1.1.5.3"},
+	{Name: ".1.3.6.1.2.1.2.2.1.1.3", Type: gosnmp.Integer, Value: 3},
+	{Name: ".1.3.6.1.2.1.2.2.1.8.3", Type: gosnmp.Integer, Value: 2},
+}
+
+func usm(engineID string, priv string) *gosnmp.UsmSecurityParameters {
+	return &gosnmp.UsmSecurityParameters{
+		UserName:                 "trapper",
+		AuthenticationProtocol:   gosnmp.SHA,
+		AuthenticationPassphrase: "authpassphrase",
+		PrivacyProtocol:          gosnmp.AES,
+		PrivacyPassphrase:        priv,
+		AuthoritativeEngineID:    engineID,
+		AuthoritativeEngineBoots: 1,
+		AuthoritativeEngineTime:  100,
+	}
+}
+
+// encode encodes a trap. gosnmp only localizes the keys when sending or
+// receiving, so we "receive" nothing first to get that done.
+func encode(gs *gosnmp.GoSNMP) ([]byte, error) {
+	if gs.Version == gosnmp.Version3 {
+		gs.UnmarshalTrap(nil, false)
+	}
+	return gs.SnmpEncodePacket(gosnmp.SNMPv2Trap, linkDown, 0, 0)
+}
+
+func TestReceiver(t *testing.T) {
+	err := smierte.Init(svipul.Config.MibModules, []string{"../../mibs/modules"})
+	if err != nil {
+		t.Fatalf("failed to load smi modules: %v", err)
+	}
+	svipul.Config.TrapCommunities = []string{"public"}
+	svipul.Config.TrapUsers = []svipul.V3{{
+		Username:       "trapper",
+		AuthPassphrase: "authpassphrase",
+		PrivPassphrase: "privpassphrase",
+	}}
+	r := Receiver{}
+	if err := r.setup(); err != nil {
+		t.Fatalf("setup failed: %v", err)
+	}
+	remote := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 162}
+	engineID := "\x80\x00\x00\x00\x04agent1"
+
+	v2c := &gosnmp.GoSNMP{Version: gosnmp.Version2c, Community: "public"}
+	v3 := &gosnmp.GoSNMP{
+		Version:            gosnmp.Version3,
+		SecurityModel:      gosnmp.UserSecurityModel,
+		MsgFlags:           gosnmp.AuthPriv,
+		SecurityParameters: usm(engineID, "privpassphrase"),
+	}
+	for _, gs := range []*gosnmp.GoSNMP{v2c, v3} {
+		msg, err := encode(gs)
+		if err != nil {
+			t.Fatalf("encoding failed: %v", err)
+		}
+		pkt, err := r.decode(nil, msg, remote)
+		if err != nil || pkt == nil {
+			t.Fatalf("v%s: decode failed: %v", versionName(gs.Version), err)
+		}
+		m := r.metric(pkt, remote)
+		if m.Metadata["trap"] != "linkDown" {
+			t.Errorf("v%s: expected trap linkDown, got %v", versionName(gs.Version), m.Metadata["trap"])
+		}
+		if m.Data["ifOperStatus.3"] != "down(2)" {
+			t.Errorf("v%s: expected ifOperStatus.3 down(2), got %v", versionName(gs.Version), m.Data["ifOperStatus.3"])
+		}
+		if _, ok := m.Data["snmpTrapOID.0"]; ok {
+			t.Errorf("v%s: snmpTrapOID.0 should only be in metadata", versionName(gs.Version))
+		}
+	}
+
+	bad := []*gosnmp.GoSNMP{
+		{Version: gosnmp.Version2c, Community: "private"},
+		{
+			Version:            gosnmp.Version3,
+			SecurityModel:      gosnmp.UserSecurityModel,
+			MsgFlags:           gosnmp.AuthPriv,
+			SecurityParameters: usm(engineID, "wrongpassphrase"),
+		},
+		{
+			Version:            gosnmp.Version3,
+			SecurityModel:      gosnmp.UserSecurityModel,
+			MsgFlags:           gosnmp.NoAuthNoPriv,
+			SecurityParameters: &gosnmp.UsmSecurityParameters{UserName: "trapper", AuthoritativeEngineID: engineID},
+		},
+	}
+	for i, gs := range bad {
+		msg, err := encode(gs)
+		if err != nil {
+			t.Fatalf("encoding failed: %v", err)
+		}
+		pkt, err := r.decode(nil, msg, remote)
+		if err == nil {
+			t.Errorf("bad trap %d accepted: %v", i, pkt.Variables)
+		}
+	}
+}
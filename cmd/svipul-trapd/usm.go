@@ -0,0 +1,196 @@
+/*
+ * svipul trap receiver - SNMPv3 handling
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/telenornms/svipul/session"
+)
+
+// The gosnmp trap listener only knows a single user, with keys localized
+// to a single engine ID. That doesn't work for traps, where the sender is
+// authoritative and every agent has its own engine ID. So we peek at the
+// USM header ourselves, and keep a decoder per engine ID and user.
+
+const usmStatsUnknownEngineIDs = ".1.3.6.1.6.3.15.1.1.4.0"
+
+// maxDecoders caps the decoder cache. It's simply reset when full, which
+// only costs a key localization per agent.
+const maxDecoders = 10000
+
+// header is the part of the SNMP message we need before we can decode it.
+// engineID and user are only set for SNMPv3.
+type header struct {
+	version  gosnmp.SnmpVersion
+	engineID string
+	user     string
+}
+
+// peek parses the SNMP version and, for SNMPv3, the engine ID and user
+// name of a message.
+func peek(msg []byte) (header, error) {
+	var h header
+	tag, msg, _, err := session.TLV(msg)
+	if err != nil {
+		return h, err
+	}
+	if tag != 0x30 {
+		return h, fmt.Errorf("not an SNMP message")
+	}
+	tag, v, rest, err := session.TLV(msg)
+	if err != nil {
+		return h, err
+	}
+	if tag != 0x02 || len(v) != 1 {
+		return h, fmt.Errorf("invalid SNMP version")
+	}
+	h.version = gosnmp.SnmpVersion(v[0])
+	if h.version != gosnmp.Version3 {
+		return h, nil
+	}
+	// msgGlobalData, then msgSecurityParameters: an octet string
+	// wrapping the USM sequence.
+	_, _, rest, err = session.TLV(rest)
+	if err != nil {
+		return h, err
+	}
+	tag, sp, _, err := session.TLV(rest)
+	if err != nil {
+		return h, err
+	}
+	if tag != 0x04 {
+		return h, fmt.Errorf("invalid security parameters")
+	}
+	_, sp, _, err = session.TLV(sp)
+	if err != nil {
+		return h, err
+	}
+	var fields [4][]byte // engine ID, boots, time, user name
+	for i := range fields {
+		_, fields[i], sp, err = session.TLV(sp)
+		if err != nil {
+			return h, err
+		}
+	}
+	h.engineID = string(fields[0])
+	h.user = string(fields[3])
+	return h, nil
+}
+
+// decoder returns a gosnmp instance set up to authenticate and decrypt
+// messages from engineID for user.
+func (r *Receiver) decoder(engineID string, user string) (*gosnmp.GoSNMP, error) {
+	v, ok := r.users[user]
+	if !ok {
+		return nil, fmt.Errorf("unknown user %q", user)
+	}
+	key := engineID + "\x00" + user
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if d, ok := r.decoders[key]; ok {
+		return d, nil
+	}
+	flags, usm, err := session.USM(&v)
+	if err != nil {
+		return nil, err
+	}
+	usm.AuthoritativeEngineID = engineID
+	d := &gosnmp.GoSNMP{
+		Version:            gosnmp.Version3,
+		SecurityModel:      gosnmp.UserSecurityModel,
+		MsgFlags:           flags,
+		SecurityParameters: usm,
+	}
+	if len(r.decoders) >= maxDecoders {
+		r.decoders = make(map[string]*gosnmp.GoSNMP)
+	}
+	r.decoders[key] = d
+	return d, nil
+}
+
+// decodeV3 authenticates and decodes an SNMPv3 message. gosnmp only
+// checks the authentication if the message claims to be authenticated, so
+// we also make sure it's at least at the level configured for the user.
+func (r *Receiver) decodeV3(msg []byte, h header) (*gosnmp.SnmpPacket, error) {
+	d, err := r.decoder(h.engineID, h.user)
+	if err != nil {
+		return nil, err
+	}
+	pkt, err := d.UnmarshalTrap(msg, false)
+	if err != nil {
+		return nil, err
+	}
+	if pkt.MsgFlags&gosnmp.AuthPriv < d.MsgFlags&gosnmp.AuthPriv {
+		return nil, fmt.Errorf("security level of message is lower than configured for user %q", h.user)
+	}
+	if d.MsgFlags&gosnmp.AuthNoPriv != 0 {
+		usm, ok := pkt.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+		if !ok || len(usm.AuthenticationParameters) < 12 {
+			return nil, fmt.Errorf("missing authentication parameters")
+		}
+	}
+	if pkt.PDUType == gosnmp.InformRequest && h.engineID != r.engineID {
+		return nil, fmt.Errorf("inform for engine ID %x, which isn't ours", h.engineID)
+	}
+	return pkt, nil
+}
+
+// report answers engine ID discovery, which a sender does before sending
+// SNMPv3 informs, since the receiver is authoritative for those. The
+// answer is a report with our engine ID, boots and time.
+func (r *Receiver) report(conn *net.UDPConn, msg []byte, h header, remote *net.UDPAddr) error {
+	if r.engineID == "" {
+		return fmt.Errorf("got SNMPv3 engine ID discovery, but TrapEngineID isn't configured")
+	}
+	d := &gosnmp.GoSNMP{
+		Version:            gosnmp.Version3,
+		SecurityModel:      gosnmp.UserSecurityModel,
+		MsgFlags:           gosnmp.NoAuthNoPriv,
+		SecurityParameters: &gosnmp.UsmSecurityParameters{},
+	}
+	pkt, err := d.UnmarshalTrap(msg, false)
+	if err != nil {
+		return fmt.Errorf("unable to decode engine ID discovery: %w", err)
+	}
+	pkt.PDUType = gosnmp.Report
+	pkt.MsgFlags = gosnmp.NoAuthNoPriv
+	pkt.ContextEngineID = r.engineID
+	pkt.SecurityParameters = &gosnmp.UsmSecurityParameters{
+		UserName:                 h.user,
+		AuthoritativeEngineID:    r.engineID,
+		AuthoritativeEngineBoots: 1,
+		AuthoritativeEngineTime:  uint32(time.Since(r.boot).Seconds()),
+	}
+	pkt.Variables = []gosnmp.SnmpPDU{{
+		Name:  usmStatsUnknownEngineIDs,
+		Type:  gosnmp.Counter32,
+		Value: atomic.AddUint32(&r.unknownEngineIDs, 1),
+	}}
+	return r.send(conn, pkt, remote)
+}
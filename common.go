@@ -24,8 +24,13 @@
 package svipul
 
 import (
+	"context"
+	"fmt"
+	"time"
+
 	"github.com/gosnmp/gosnmp"
 	"github.com/sleepinggenius2/gosmi/models"
+	"github.com/sleepinggenius2/gosmi/types"
 )
 
 // Node is a rendered SMI node, e.g.: the result of a lookup. Usually
@@ -38,7 +43,8 @@ type Node struct {
 	Qualified string // .1.3.6.1.2.1.1.1.0 // "full", with index
 	Format    string // 255a <-- possibly obsolete
 	Type      *models.Type
-	Lookedup  bool // True if key was not a pure OID
+	Access    types.Access // MIB access, e.g.: ReadOnly or ReadWrite (which includes read-create)
+	Lookedup  bool         // True if key was not a pure OID
 }
 
 // Walker is an interface for performing a BulkWalk, without having to
@@ -46,5 +52,206 @@ type Node struct {
 // and session.Session type implements it. Since it's tied to both a Node
 // and a gosnmp.SnmpPDU type, it's rather strongly connected to SNMP atm.
 type Walker interface {
-	BulkWalk(node []Node, cb func(pdu gosnmp.SnmpPDU) error) error
+	BulkWalk(ctx context.Context, node []Node, cb func(pdu gosnmp.SnmpPDU) error) error
+}
+
+// V3 holds the SNMPv3 User-based Security Model (USM) parameters for a
+// target. Level is one of noAuthNoPriv, authNoPriv or authPriv. If Level
+// is blank, it is derived from which passphrases are set. The protocols
+// default to SHA and AES if a passphrase is provided without a protocol.
+type V3 struct {
+	Username       string
+	Level          string `json:",omitempty"`
+	AuthProtocol   string `json:",omitempty"` // MD5, SHA, SHA224, SHA256, SHA384, SHA512
+	AuthPassphrase string `json:",omitempty"`
+	PrivProtocol   string `json:",omitempty"` // DES, AES, AES192, AES256, AES192C, AES256C
+	PrivPassphrase string `json:",omitempty"`
+	Context        string `json:",omitempty"` // Context name, blank for default context
+}
+
+// Redacted replaces secrets in logs and results.
+const Redacted = "<redacted>"
+
+// Redact returns Redacted, or a blank string if there's no secret.
+func Redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return Redacted
+}
+
+// Redacted returns v with the passphrases redacted.
+func (v V3) Redacted() V3 {
+	v.AuthPassphrase = Redact(v.AuthPassphrase)
+	v.PrivPassphrase = Redact(v.PrivPassphrase)
+	return v
+}
+
+// String and GoString keep the passphrases out of logs, even with %+v or
+// %#v.
+func (v V3) String() string {
+	type plain V3
+	return fmt.Sprintf("%+v", plain(v.Redacted()))
+}
+
+func (v V3) GoString() string {
+	type plain V3
+	return fmt.Sprintf("%#v", plain(v.Redacted()))
+}
+
+// Credential is one way of talking to a target: an SNMP version, and a
+// community or SNMPv3 parameters. Name is only used when reporting which
+// credential works, so the secrets themselves are never passed on.
+type Credential struct {
+	Name      string `json:",omitempty"`
+	Version   string `json:",omitempty"` // 1, 2c or 3. Blank == 3 if V3 is set, otherwise 2c
+	Community string `json:",omitempty"`
+	V3        *V3    `json:",omitempty"`
+}
+
+// Redacted returns c with the community and passphrases redacted.
+func (c Credential) Redacted() Credential {
+	c.Community = Redact(c.Community)
+	if c.V3 != nil {
+		v3 := c.V3.Redacted()
+		c.V3 = &v3
+	}
+	return c
+}
+
+func (c Credential) String() string {
+	type plain Credential
+	return fmt.Sprintf("%+v", plain(c.Redacted()))
+}
+
+func (c Credential) GoString() string {
+	type plain Credential
+	return fmt.Sprintf("%#v", plain(c.Redacted()))
+}
+
+// Duration is a time.Duration that is read from and written as a string,
+// e.g. "3s" or "1m30s", both in JSON and TOML.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	p, err := time.ParseDuration(string(b))
+	if err != nil {
+		return fmt.Errorf("invalid duration: %w", err)
+	}
+	*d = Duration(p)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Timing holds SNMP timing, batching and walk limit parameters. It is used for the
+// defaults in the config, per-host overrides in the inventory and
+// per-order overrides, and is embedded in all of them. Unset (zero/nil)
+// values mean "use whatever the next level says", see Merge.
+type Timing struct {
+	Timeout            Duration `json:",omitempty"` // Timeout per request, doubled per retry if ExponentialTimeout
+	Retries            *int     `json:",omitempty"` // Retries per request
+	ExponentialTimeout *bool    `json:",omitempty"` // Double timeout for each retry
+	MaxOids            int      `json:",omitempty"` // Maximum OIDs per Get request
+	MaxRepetitions     int      `json:",omitempty"` // GetBulk max-repetitions
+	MaxWalkTime        Duration `json:",omitempty"` // Maximum wall-clock time of a single walk
+	MaxVarbinds        int      `json:",omitempty"` // Maximum varbinds received in a single walk
+}
+
+// Sane bounds for Timing, enforced by Validate.
+const (
+	MinTimeout        = Duration(100 * time.Millisecond)
+	MaxTimeout        = Duration(60 * time.Second)
+	MaxRetries        = 10
+	MaxOidsPerGet     = gosnmp.MaxOids
+	MaxMaxRepetitions = 200
+	MinWalkTime       = Duration(time.Second)
+	MaxWalkTime       = Duration(time.Hour)
+)
+
+// Merge returns t with all unset fields filled in from d.
+func (t Timing) Merge(d Timing) Timing {
+	if t.Timeout == 0 {
+		t.Timeout = d.Timeout
+	}
+	if t.Retries == nil {
+		t.Retries = d.Retries
+	}
+	if t.ExponentialTimeout == nil {
+		t.ExponentialTimeout = d.ExponentialTimeout
+	}
+	if t.MaxOids == 0 {
+		t.MaxOids = d.MaxOids
+	}
+	if t.MaxRepetitions == 0 {
+		t.MaxRepetitions = d.MaxRepetitions
+	}
+	if t.MaxWalkTime == 0 {
+		t.MaxWalkTime = d.MaxWalkTime
+	}
+	if t.MaxVarbinds == 0 {
+		t.MaxVarbinds = d.MaxVarbinds
+	}
+	return t
+}
+
+// Validate checks that the values that are set are within sane bounds.
+func (t Timing) Validate() error {
+	if t.Timeout != 0 && (t.Timeout < MinTimeout || t.Timeout > MaxTimeout) {
+		return fmt.Errorf("timeout %s out of bounds (%s - %s)", time.Duration(t.Timeout), time.Duration(MinTimeout), time.Duration(MaxTimeout))
+	}
+	if t.Retries != nil && (*t.Retries < 0 || *t.Retries > MaxRetries) {
+		return fmt.Errorf("retries %d out of bounds (0 - %d)", *t.Retries, MaxRetries)
+	}
+	if t.MaxOids < 0 || t.MaxOids > MaxOidsPerGet {
+		return fmt.Errorf("max oids %d out of bounds (1 - %d)", t.MaxOids, MaxOidsPerGet)
+	}
+	if t.MaxRepetitions < 0 || t.MaxRepetitions > MaxMaxRepetitions {
+		return fmt.Errorf("max repetitions %d out of bounds (1 - %d)", t.MaxRepetitions, MaxMaxRepetitions)
+	}
+	if t.MaxWalkTime != 0 && (t.MaxWalkTime < MinWalkTime || t.MaxWalkTime > MaxWalkTime) {
+		return fmt.Errorf("max walk time %s out of bounds (%s - %s)", time.Duration(t.MaxWalkTime), time.Duration(MinWalkTime), time.Duration(MaxWalkTime))
+	}
+	if t.MaxVarbinds < 0 {
+		return fmt.Errorf("max varbinds %d can't be negative", t.MaxVarbinds)
+	}
+	return nil
+}
+
+// Rate is the request budget of a single target, which protects it from
+// being flooded, e.g. by a huge walk or many orders in a row. It is set in
+// the config, with per-host overrides in the inventory, but deliberately
+// not per order. Zero means unlimited.
+type Rate struct {
+	MaxPDURate  float64 `json:",omitempty"` // Requests per second, retries included
+	MaxByteRate int     `json:",omitempty"` // Bytes per second, requests and responses
+}
+
+// Merge returns r with all unset fields filled in from d.
+func (r Rate) Merge(d Rate) Rate {
+	if r.MaxPDURate == 0 {
+		r.MaxPDURate = d.MaxPDURate
+	}
+	if r.MaxByteRate == 0 {
+		r.MaxByteRate = d.MaxByteRate
+	}
+	return r
+}
+
+// Validate checks that the rates aren't negative.
+func (r Rate) Validate() error {
+	if r.MaxPDURate < 0 {
+		return fmt.Errorf("max pdu rate %g can't be negative", r.MaxPDURate)
+	}
+	if r.MaxByteRate < 0 {
+		return fmt.Errorf("max byte rate %d can't be negative", r.MaxByteRate)
+	}
+	return nil
+}
+
+// Limited returns true if any rate is set.
+func (r Rate) Limited() bool {
+	return r.MaxPDURate > 0 || r.MaxByteRate > 0
 }
@@ -0,0 +1,122 @@
+/*
+ * svipul common data definition tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package svipul_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/telenornms/svipul"
+)
+
+func intp(i int) *int {
+	return &i
+}
+
+func boolp(b bool) *bool {
+	return &b
+}
+
+func TestTimingValidate(t *testing.T) {
+	cases := []struct {
+		timing svipul.Timing
+		ok     bool
+	}{
+		{svipul.Timing{}, true}, // Zero means unset, not zero
+		{svipul.Timing{Timeout: svipul.MinTimeout, Retries: intp(0), MaxOids: 1, MaxRepetitions: 1, MaxWalkTime: svipul.MinWalkTime}, true},
+		{svipul.Timing{Timeout: svipul.MaxTimeout, Retries: intp(svipul.MaxRetries), MaxOids: svipul.MaxOidsPerGet, MaxRepetitions: svipul.MaxMaxRepetitions, MaxWalkTime: svipul.MaxWalkTime, MaxVarbinds: 1}, true},
+		{svipul.Timing{Timeout: svipul.MinTimeout - 1}, false},
+		{svipul.Timing{Timeout: svipul.MaxTimeout + 1}, false},
+		{svipul.Timing{Timeout: svipul.Duration(-time.Second)}, false},
+		{svipul.Timing{Retries: intp(-1)}, false},
+		{svipul.Timing{Retries: intp(svipul.MaxRetries + 1)}, false},
+		{svipul.Timing{MaxOids: -1}, false},
+		{svipul.Timing{MaxOids: svipul.MaxOidsPerGet + 1}, false},
+		{svipul.Timing{MaxRepetitions: -1}, false},
+		{svipul.Timing{MaxRepetitions: svipul.MaxMaxRepetitions + 1}, false},
+		{svipul.Timing{MaxWalkTime: svipul.MinWalkTime - 1}, false},
+		{svipul.Timing{MaxWalkTime: svipul.MaxWalkTime + 1}, false},
+		{svipul.Timing{MaxVarbinds: -1}, false},
+	}
+	for _, c := range cases {
+		if err := c.timing.Validate(); (err == nil) != c.ok {
+			t.Errorf("%+v: expected ok %v, got %v", c.timing, c.ok, err)
+		}
+	}
+}
+
+func TestTimingMerge(t *testing.T) {
+	defaults := svipul.Timing{
+		Timeout:            svipul.Duration(3 * time.Second),
+		Retries:            intp(1),
+		ExponentialTimeout: boolp(true),
+		MaxOids:            50,
+		MaxRepetitions:     10,
+		MaxWalkTime:        svipul.Duration(5 * time.Minute),
+		MaxVarbinds:        1000000,
+	}
+	inventory := svipul.Timing{Timeout: svipul.Duration(5 * time.Second), Retries: intp(3), MaxRepetitions: 20}
+	cases := []struct {
+		order    svipul.Timing
+		expected svipul.Timing
+	}{
+		// Nothing in the order: the inventory, then the defaults
+		{svipul.Timing{}, svipul.Timing{
+			Timeout:            svipul.Duration(5 * time.Second),
+			Retries:            intp(3),
+			ExponentialTimeout: boolp(true),
+			MaxOids:            50,
+			MaxRepetitions:     20,
+			MaxWalkTime:        svipul.Duration(5 * time.Minute),
+			MaxVarbinds:        1000000,
+		}},
+		// The order wins, including explicit zero retries and false
+		{svipul.Timing{Timeout: svipul.Duration(time.Second), Retries: intp(0), ExponentialTimeout: boolp(false), MaxOids: 5, MaxRepetitions: 5, MaxWalkTime: svipul.Duration(time.Minute), MaxVarbinds: 10}, svipul.Timing{
+			Timeout:            svipul.Duration(time.Second),
+			Retries:            intp(0),
+			ExponentialTimeout: boolp(false),
+			MaxOids:            5,
+			MaxRepetitions:     5,
+			MaxWalkTime:        svipul.Duration(time.Minute),
+			MaxVarbinds:        10,
+		}},
+		// Some from each
+		{svipul.Timing{MaxOids: 5}, svipul.Timing{
+			Timeout:            svipul.Duration(5 * time.Second),
+			Retries:            intp(3),
+			ExponentialTimeout: boolp(true),
+			MaxOids:            5,
+			MaxRepetitions:     20,
+			MaxWalkTime:        svipul.Duration(5 * time.Minute),
+			MaxVarbinds:        1000000,
+		}},
+	}
+	for _, c := range cases {
+		got := c.order.Merge(inventory).Merge(defaults)
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%+v: expected %+v, got %+v", c.order, c.expected, got)
+		}
+	}
+}
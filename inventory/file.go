@@ -0,0 +1,319 @@
+/*
+ * svipul file-backed inventory
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package inventory
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/telenornms/svipul"
+)
+
+// The inventory file, if any. hosts is replaced as a whole on reload, so
+// a Host looked up is never modified underneath.
+var inv struct {
+	lock  sync.RWMutex
+	path  string
+	hosts map[string]Host
+	stamp string // Modification time and size of the file, see stamp()
+}
+
+// Load reads the inventory file f, and uses it for LockHost from now on.
+// The format is given by the extension: .toml, .json or .csv.
+//
+// TOML and JSON files hold a Hosts table keyed by target, i.e. what
+// orders use as Target, with the fields of Host, plus Tags:
+//
+//	[Hosts.router1]
+//	Address = "192.0.2.1"
+//	Community = "secret"
+//	Tags = ["core", "oslo"]
+//
+//	[Hosts.router2.V3]
+//	Username = "svipul"
+//	...
+//
+// Address defaults to the target. CSV files have a header row naming the
+// columns: Target, then any of the Host fields, with the V3 fields
+// (Username, AuthPassphrase, ...) as columns of their own and Tags
+// separated by spaces. Blank cells are left unset.
+//
+// Unknown keys, fields and columns are errors, so a misspelled field isn't
+// silently ignored. If the file can't be read or has errors, the inventory
+// in use is kept.
+func Load(f string) error {
+	st, err := stamp(f)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(f)
+	if err != nil {
+		return err
+	}
+	hosts, err := parse(filepath.Ext(f), b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f, err)
+	}
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+	inv.path = f
+	inv.hosts = hosts
+	inv.stamp = st
+	return nil
+}
+
+// Reload reads the inventory file again, if there is one.
+func Reload() error {
+	inv.lock.RLock()
+	f := inv.path
+	inv.lock.RUnlock()
+	if f == "" {
+		return nil
+	}
+	return Load(f)
+}
+
+// Unload drops the inventory file, so LockHost goes by what Remember has
+// learned and the configured defaults only.
+func Unload() {
+	inv.lock.Lock()
+	defer inv.lock.Unlock()
+	inv.path = ""
+	inv.hosts = nil
+	inv.stamp = ""
+}
+
+// Watch checks the inventory file for changes every interval, reloading it
+// when it has changed. Errors are logged. It never returns.
+func Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		inv.lock.RLock()
+		f, old := inv.path, inv.stamp
+		inv.lock.RUnlock()
+		if f == "" {
+			continue
+		}
+		st, err := stamp(f)
+		if err != nil || st == old {
+			continue
+		}
+		if err := Load(f); err != nil {
+			svipul.Logf("Inventory changed, but reloading failed, keeping the old one: %s", err)
+			continue
+		}
+		svipul.Logf("Inventory reloaded from %s", f)
+	}
+}
+
+// stamp identifies a version of the file f, by modification time and size.
+func stamp(f string) (string, error) {
+	fi, err := os.Stat(f)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d/%d", fi.ModTime().UnixNano(), fi.Size()), nil
+}
+
+// lookup returns the inventory entry of target t, if any.
+func lookup(t string) (Host, bool) {
+	inv.lock.RLock()
+	defer inv.lock.RUnlock()
+	h, ok := inv.hosts[t]
+	return h, ok
+}
+
+// Address returns the address of target t: its Address in the inventory
+// file, or t itself. Per-target state in the session package, e.g. the
+// circuit breaker, is kept by address.
+func Address(t string) string {
+	if h, ok := lookup(t); ok {
+		return h.Address
+	}
+	return t
+}
+
+// undecoded returns an error listing the keys of a TOML file that didn't
+// match any field, if any.
+func undecoded(md toml.MetaData) error {
+	if len(md.Undecoded()) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(md.Undecoded()))
+	for _, k := range md.Undecoded() {
+		keys = append(keys, k.String())
+	}
+	return fmt.Errorf("unknown keys %s", strings.Join(keys, ", "))
+}
+
+func parse(ext string, b []byte) (map[string]Host, error) {
+	var f struct {
+		Hosts map[string]Host
+	}
+	var err error
+	switch strings.ToLower(ext) {
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(b), &f)
+		if err == nil {
+			err = undecoded(md)
+		}
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&f)
+	case ".csv":
+		f.Hosts, err = parseCSV(b)
+	default:
+		return nil, fmt.Errorf("unknown inventory format %q, expected .toml, .json or .csv", ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for t, h := range f.Hosts {
+		if h.Address == "" {
+			h.Address = t
+		}
+		if err := h.Timing.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: invalid timing parameters: %w", t, err)
+		}
+		if err := h.Rate.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: invalid rate limits: %w", t, err)
+		}
+		f.Hosts[t] = h
+	}
+	return f.Hosts, nil
+}
+
+// Column types of CSV inventories. Rows are turned into JSON objects and
+// decoded like a JSON inventory, so the rules are the same.
+var csvColumns = map[string]string{
+	"Address":            "string",
+	"Port":               "number",
+	"Transport":          "string",
+	"Community":          "string",
+	"Version":            "string",
+	"Credential":         "string",
+	"Tags":               "list",
+	"Timeout":            "string",
+	"Retries":            "number",
+	"ExponentialTimeout": "bool",
+	"MaxOids":            "number",
+	"MaxRepetitions":     "number",
+	"MaxWalkTime":        "string",
+	"MaxVarbinds":        "number",
+	"MaxPDURate":         "number",
+	"MaxByteRate":        "number",
+	"Username":           "v3",
+	"Level":              "v3",
+	"AuthProtocol":       "v3",
+	"AuthPassphrase":     "v3",
+	"PrivProtocol":       "v3",
+	"PrivPassphrase":     "v3",
+	"Context":            "v3",
+}
+
+func parseCSV(b []byte) (map[string]Host, error) {
+	r := csv.NewReader(bytes.NewReader(b))
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("missing header: %w", err)
+	}
+	target := -1
+	for i, c := range header {
+		header[i] = strings.TrimSpace(c)
+		if header[i] == "Target" {
+			target = i
+		} else if csvColumns[header[i]] == "" {
+			return nil, fmt.Errorf("unknown column %q", header[i])
+		}
+	}
+	if target < 0 {
+		return nil, fmt.Errorf("missing Target column")
+	}
+	hosts := make(map[string]Host)
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := r.FieldPos(0)
+		obj := make(map[string]interface{})
+		v3 := make(map[string]interface{})
+		for i, c := range row {
+			c = strings.TrimSpace(c)
+			if i == target || c == "" {
+				continue
+			}
+			col := header[i]
+			switch csvColumns[col] {
+			case "string":
+				obj[col] = c
+			case "number":
+				obj[col] = json.Number(c)
+			case "bool":
+				v, err := strconv.ParseBool(c)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %s: %w", line, col, err)
+				}
+				obj[col] = v
+			case "list":
+				obj[col] = strings.Fields(c)
+			case "v3":
+				v3[col] = c
+			}
+		}
+		if len(v3) > 0 {
+			obj["V3"] = v3
+		}
+		t := strings.TrimSpace(row[target])
+		if t == "" {
+			return nil, fmt.Errorf("line %d: blank target", line)
+		}
+		j, err := json.Marshal(obj)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		var h Host
+		if err := json.Unmarshal(j, &h); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		hosts[t] = h
+	}
+	return hosts, nil
+}
@@ -0,0 +1,161 @@
+/*
+ * svipul inventory file tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package inventory
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/telenornms/svipul"
+)
+
+// The same inventory in all formats.
+var files = map[string]string{
+	"hosts.toml": `
+[Hosts.router1]
+Address = "192.0.2.1"
+Port = 1161
+Community = "secret"
+Tags = ["core", "oslo"]
+Retries = 3
+MaxPDURate = 5.0
+
+[Hosts.router2]
+[Hosts.router2.V3]
+Username = "svipul"
+AuthPassphrase = "password"
+`,
+	"hosts.json": `{"Hosts": {
+	"router1": {"Address": "192.0.2.1", "Port": 1161, "Community": "secret",
+		"Tags": ["core", "oslo"], "Retries": 3, "MaxPDURate": 5},
+	"router2": {"V3": {"Username": "svipul", "AuthPassphrase": "password"}}
+}}`,
+	"hosts.csv": `# Comments are fine
+Target,Address,Port,Community,Tags,Retries,MaxPDURate,Username,AuthPassphrase
+router1,192.0.2.1,1161,secret,core oslo,3,5,,
+router2,,,,,,,svipul,password
+`,
+}
+
+func TestLoad(t *testing.T) {
+	retries := 3
+	expected := map[string]Host{
+		"router1": {
+			Address:   "192.0.2.1",
+			Port:      1161,
+			Community: "secret",
+			Tags:      []string{"core", "oslo"},
+			Timing:    svipul.Timing{Retries: &retries},
+			Rate:      svipul.Rate{MaxPDURate: 5},
+		},
+		"router2": {
+			Address: "router2",
+			V3:      &svipul.V3{Username: "svipul", AuthPassphrase: "password"},
+		},
+	}
+	dir := t.TempDir()
+	for name, content := range files {
+		f := filepath.Join(dir, name)
+		os.WriteFile(f, []byte(content), 0644)
+		if err := Load(f); err != nil {
+			t.Errorf("%s: load failed: %v", name, err)
+			continue
+		}
+		for target, e := range expected {
+			h, ok := lookup(target)
+			if !ok || !reflect.DeepEqual(h, e) {
+				t.Errorf("%s: expected %s to be %+v, got %+v", name, target, e, h)
+			}
+		}
+	}
+
+	f := filepath.Join(dir, "hosts.csv")
+	if err := Load(f); err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	os.WriteFile(f, []byte("Target,Bogus\nrouter3,1\n"), 0644)
+	if err := Reload(); err == nil {
+		t.Errorf("unknown CSV column accepted")
+	}
+	typo := filepath.Join(dir, "typo.toml")
+	os.WriteFile(typo, []byte("[Hosts.router3]\nComunity = \"other\"\n"), 0644)
+	if err := Load(typo); err == nil || !strings.Contains(err.Error(), "Hosts.router3.Comunity") {
+		t.Errorf("unknown TOML key not reported: %v", err)
+	}
+	typo = filepath.Join(dir, "typo.json")
+	os.WriteFile(typo, []byte(`{"Hosts": {"router3": {"Comunity": "other"}}}`), 0644)
+	if err := Load(typo); err == nil {
+		t.Errorf("unknown JSON field accepted")
+	}
+	if _, ok := lookup("router1"); !ok {
+		t.Errorf("failed reload dropped the old inventory")
+	}
+	os.WriteFile(f, []byte("Target,Community\nrouter3,other\n"), 0644)
+	if err := Reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if _, ok := lookup("router1"); ok {
+		t.Errorf("router1 still in the inventory after reload")
+	}
+
+	svipul.Config.LockWait = svipul.Duration(time.Second)
+	h, err := LockHost(context.Background(), "router3")
+	if err != nil {
+		t.Fatalf("unable to lock router3: %v", err)
+	}
+	h.Unlock()
+	if h.Address != "router3" || h.Community != "other" {
+		t.Errorf("inventory not used by LockHost, got %+v", h)
+	}
+	h, _ = LockHost(context.Background(), "router4")
+	h.Unlock()
+	if h.Community != svipul.Config.DefaultCommunity {
+		t.Errorf("expected default community for unknown host, got %q", h.Community)
+	}
+
+	Remember("router3", svipul.Credential{Community: "learned"})
+	Remember("router4", svipul.Credential{Community: "learned"})
+	defer Forget("router3")
+	defer Forget("router4")
+	for target, community := range map[string]string{"router3": "other", "router4": "learned"} {
+		h, _ = LockHost(context.Background(), target)
+		h.Unlock()
+		if h.Community != community {
+			t.Errorf("expected community %q for %s, got %q", community, target, h.Community)
+		}
+	}
+
+	Unload()
+	if _, ok := lookup("router3"); ok || Address("router3") != "router3" {
+		t.Errorf("router3 still in the inventory after unload")
+	}
+	if err := Reload(); err != nil {
+		t.Errorf("reload without an inventory failed: %v", err)
+	}
+}
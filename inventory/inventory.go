@@ -24,38 +24,310 @@
 /*
 Package inventory deals with inventory locking and syncing.
 
-Today, this is mostly a dummy-package, but the intention is to sync it with
-a central database.
+Targets are locked within a worker by LockHost, and across workers through
+a Locker, the lock backend: in memory by default, or svipul-lockd when
+LockServer is set. Credentials come from an inventory file, see Load,
+or the defaults in the configuration.
 */
 package inventory
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/telenornms/svipul"
 	"sync"
+	"time"
 )
 
-var targets sync.Map
+// hostLock is the lock of a single target. Orders waiting for it queue up
+// in waiters, and get it in the order they arrived.
+type hostLock struct {
+	waiters []chan struct{}
+}
+
+var (
+	lock    sync.Mutex
+	targets = make(map[string]*hostLock) // Locked targets
+)
 
+// Host is a target and the credentials used to talk to it. Version is the
+// SNMP version (1, 2c or 3), if it is blank SNMPv3 is used if V3 is set,
+// otherwise v2c.
+//
+// Address can be a host name or address, optionally with a port, e.g.
+// "router1:1161" or "[2001:db8::1]:1161". Port is used if the address has
+// no port. Transport is udp, udp4, udp6, tcp, tcp4 or tcp6, blank means
+// udp.
+//
+// The embedded Timing holds per-host timing overrides and Rate the
+// per-host request budget, blank values are filled in from the
+// configuration defaults.
+//
+// Tags are free-form labels from the inventory file, passed on with the
+// results. Credential names a credential to use instead of Community, V3
+// and Version, see LookupCredential.
 type Host struct {
-	Address   string
-	Community string
+	Address    string
+	Port       uint16
+	Transport  string
+	Community  string
+	Version    string
+	V3         *svipul.V3
+	Credential string
+	Tags       []string
+	svipul.Timing
+	svipul.Rate
+
+	target  string                  // What was locked, Address may differ
+	renewal chan struct{}           // Closed to stop renewing the lease
+	ctx     context.Context         // Done when the lock is released or lost
+	cancel  context.CancelCauseFunc // Cancels ctx
 }
 
+// ErrLeaseLost is the cause of the cancellation of Host.Context when the
+// lease on the target could not be renewed.
+var ErrLeaseLost = errors.New("lost the lease on the target")
+
 // LockHost acquires a host-level lock and relevant credentials. Must call
-// h.Unlock() when done.
-func LockHost(t string) (Host, error) {
-	h := Host{}
-	_, loaded := targets.LoadOrStore(t, 1)
-	if loaded {
-		return h, fmt.Errorf("target still locked, refusing to start more runs")
-	}
-	h.Address = t
-	h.Community = svipul.Config.DefaultCommunity
+// h.Unlock() when done. The credentials come from the inventory file, if
+// the target is in it, see Load, then what Remember has learned about it,
+// falling back to the configured defaults.
+//
+// If the host is already locked, it waits in line for up to LockWait, or
+// until ctx is done, whichever comes first. Waiting orders get the lock in
+// the order they arrived.
+//
+// Once first in line, it also takes a lease from the lock backend, which
+// keeps other workers away from the target when LockServer is set. The
+// lease is renewed until Unlock. If another worker holds it, we keep
+// trying until the wait is over. If renewing the lease fails, the
+// context returned by h.Context() is cancelled with ErrLeaseLost, so the
+// order doesn't carry on while another worker polls the target.
+func LockHost(ctx context.Context, t string) (Host, error) {
+	deadline := time.Now().Add(time.Duration(svipul.Config.LockWait))
+	err := acquire(ctx, t, deadline)
+	if err != nil {
+		return Host{}, err
+	}
+	err = lease(ctx, t, deadline)
+	if err != nil {
+		release(t)
+		return Host{}, err
+	}
+	h, ok := lookup(t)
+	if !ok {
+		h = Host{Address: t}
+	}
+	if c, ok := learned.Load(t); ok && h.Community == "" && h.V3 == nil && h.Version == "" && h.Credential == "" {
+		h.Use(c.(svipul.Credential))
+	}
+	h.target = t
+	h.ctx, h.cancel = context.WithCancelCause(ctx)
+	h.renewal = renew(t, h.cancel)
+	if h.Credential != "" {
+		c, err := LookupCredential(h.Credential)
+		if err != nil {
+			h.Unlock()
+			return Host{}, fmt.Errorf("inventory entry for %s: %w", t, err)
+		}
+		h.Use(c)
+	}
+	if h.Community == "" {
+		h.Community = svipul.Config.DefaultCommunity
+	}
+	if h.Version == "" && h.V3 == nil {
+		h.Version = svipul.Config.DefaultVersion
+	}
 	return h, nil
 }
 
-// Unlock releases the host-level lock.
+// Context returns a context derived from the one passed to LockHost, done
+// when the lock is released or the lease on the target is lost. Work on
+// the target should use it.
+func (h *Host) Context() context.Context {
+	if h.ctx == nil {
+		return context.Background()
+	}
+	return h.ctx
+}
+
+// Use sets the version, community and SNMPv3 parameters of h from c.
+func (h *Host) Use(c svipul.Credential) {
+	h.Version = c.Version
+	h.Community = c.Community
+	h.V3 = c.V3
+}
+
+// String and GoString keep the credentials out of logs.
+func (h Host) String() string {
+	return h.Address
+}
+
+func (h Host) GoString() string {
+	type plain Host
+	p := plain(h)
+	p.Community = svipul.Redact(p.Community)
+	return fmt.Sprintf("%#v", p)
+}
+
+// learned holds the credentials found to work for targets, see Remember.
+var learned sync.Map
+
+// Remember notes that c works for target t, so LockHost uses it from now
+// on, unless the inventory file says otherwise.
+func Remember(t string, c svipul.Credential) {
+	learned.Store(t, c)
+}
+
+// Forget drops what Remember knows about t.
+func Forget(t string) {
+	learned.Delete(t)
+}
+
+// acquire waits for our turn for t, within this worker.
+func acquire(ctx context.Context, t string, deadline time.Time) error {
+	lock.Lock()
+	l := targets[t]
+	if l == nil {
+		targets[t] = &hostLock{}
+		lock.Unlock()
+		return nil
+	}
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		lock.Unlock()
+		return fmt.Errorf("target still locked, refusing to start more runs")
+	}
+	ahead := len(l.waiters)
+	ch := make(chan struct{})
+	l.waiters = append(l.waiters, ch)
+	lock.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	var cause error
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		cause = fmt.Errorf("target still locked after waiting %s behind %d other orders", wait.Round(time.Millisecond), ahead)
+	case <-ctx.Done():
+		cause = fmt.Errorf("gave up waiting for the target lock behind %d other orders: %w", ahead, ctx.Err())
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	// We might have been handed the lock while giving up.
+	select {
+	case <-ch:
+		return nil
+	default:
+	}
+	for i, w := range l.waiters {
+		if w == ch {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			break
+		}
+	}
+	return cause
+}
+
+// lockPoll is how often we ask the lock backend again while another
+// worker holds the lease.
+const lockPoll = 250 * time.Millisecond
+
+// lease takes the lease on t from the lock backend.
+func lease(ctx context.Context, t string, deadline time.Time) error {
+	b, owner := backend()
+	for {
+		err := b.Lock(ctx, t, owner, time.Duration(svipul.Config.LockTTL))
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrLocked) {
+			return fmt.Errorf("%w: %w", ErrLockBackend, err)
+		}
+		if time.Until(deadline) < lockPoll {
+			return err
+		}
+		select {
+		case <-time.After(lockPoll):
+		case <-ctx.Done():
+			return fmt.Errorf("gave up waiting for the target lock: %w", ctx.Err())
+		}
+	}
+}
+
+// renew renews the lease on t every third of the TTL, until the returned
+// channel is closed. If another worker has taken the lease, or the lease
+// has expired without a successful renewal, lost is called with
+// ErrLeaseLost and renewal stops. Other failures are logged and retried
+// until then.
+func renew(t string, lost context.CancelCauseFunc) chan struct{} {
+	done := make(chan struct{})
+	ttl := time.Duration(svipul.Config.LockTTL)
+	expires := time.Now().Add(ttl)
+	go func() {
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		b, owner := backend()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				now := time.Now()
+				ctx, cancel := context.WithTimeout(context.Background(), ttl/3)
+				err := b.Lock(ctx, t, owner, ttl)
+				cancel()
+				if err == nil {
+					expires = now.Add(ttl)
+					continue
+				}
+				svipul.Logf("%s: unable to renew lock: %s", t, err)
+				if errors.Is(err, ErrLocked) || !time.Now().Before(expires) {
+					svipul.Logf("%s: lease lost, cancelling the order", t)
+					lost(ErrLeaseLost)
+					return
+				}
+			}
+		}
+	}()
+	return done
+}
+
+// release hands t over to the next order waiting for it, if any.
+func release(t string) {
+	lock.Lock()
+	defer lock.Unlock()
+	l := targets[t]
+	if l == nil {
+		return
+	}
+	if len(l.waiters) == 0 {
+		delete(targets, t)
+		return
+	}
+	close(l.waiters[0])
+	l.waiters = l.waiters[1:]
+}
+
+// Unlock releases the host-level lock, handing it over to the next order
+// waiting for it, if any.
 func (h *Host) Unlock() {
-	targets.Delete(h.Address)
+	if h.cancel != nil {
+		h.cancel(nil)
+	}
+	if h.renewal != nil {
+		close(h.renewal)
+		h.renewal = nil
+		b, owner := backend()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := b.Unlock(ctx, h.target, owner)
+		cancel()
+		if err != nil {
+			svipul.Logf("%s: unable to release lock, it will expire on its own: %s", h.target, err)
+		}
+	}
+	release(h.target)
 }
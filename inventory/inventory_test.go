@@ -0,0 +1,177 @@
+/*
+ * svipul inventory tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package inventory
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/telenornms/svipul"
+)
+
+// waiters returns how many orders are waiting for t.
+func waiters(t string) int {
+	lock.Lock()
+	defer lock.Unlock()
+	if targets[t] == nil {
+		return 0
+	}
+	return len(targets[t].waiters)
+}
+
+func locked(t string) bool {
+	lock.Lock()
+	defer lock.Unlock()
+	return targets[t] != nil
+}
+
+func TestLockHost(t *testing.T) {
+	svipul.Config.LockWait = svipul.Duration(time.Second)
+	first, err := LockHost(context.Background(), "router1")
+	if err != nil {
+		t.Fatalf("unable to lock free host: %v", err)
+	}
+	got := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			h, err := LockHost(context.Background(), "router1")
+			if err != nil {
+				t.Errorf("waiter %d failed: %v", i, err)
+				got <- -1
+				return
+			}
+			got <- i
+			h.Unlock()
+		}(i)
+		for waiters("router1") != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	first.Unlock()
+	for i := 0; i < 3; i++ {
+		if n := <-got; n != i {
+			t.Errorf("expected waiter %d to get the lock, got %d", i, n)
+		}
+	}
+	// The last waiter unlocks after reporting in
+	for i := 0; locked("router1"); i++ {
+		if i > 1000 {
+			t.Fatalf("router1 still locked after everyone is done")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	svipul.Config.LockWait = svipul.Duration(50 * time.Millisecond)
+	h, _ := LockHost(context.Background(), "router1")
+	if _, err := LockHost(context.Background(), "router1"); err == nil {
+		t.Errorf("lock wait not bounded by LockWait")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	svipul.Config.LockWait = svipul.Duration(time.Second)
+	start := time.Now()
+	if _, err := LockHost(ctx, "router1"); err == nil || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("lock wait not bounded by the context: %v after %s", err, time.Since(start))
+	}
+	if n := waiters("router1"); n != 0 {
+		t.Errorf("%d waiters left after giving up", n)
+	}
+	h.Unlock()
+}
+
+func TestLocker(t *testing.T) {
+	srv := httptest.NewServer(NewLockHandler(&Memory{}))
+	defer srv.Close()
+	ctx := context.Background()
+	for name, l := range map[string]Locker{"memory": &Memory{}, "http": &HTTPLocker{URL: srv.URL}} {
+		if err := l.Lock(ctx, "router1", "a", time.Minute); err != nil {
+			t.Fatalf("%s: unable to lock free target: %v", name, err)
+		}
+		if err := l.Lock(ctx, "router1", "a", time.Minute); err != nil {
+			t.Errorf("%s: unable to renew lease: %v", name, err)
+		}
+		if err := l.Lock(ctx, "router1", "b", time.Minute); !errors.Is(err, ErrLocked) {
+			t.Errorf("%s: expected ErrLocked for other owner, got %v", name, err)
+		}
+		if err := l.Unlock(ctx, "router1", "b"); !errors.Is(err, ErrLocked) {
+			t.Errorf("%s: other owner released the lease: %v", name, err)
+		}
+		if err := l.Unlock(ctx, "router1", "a"); err != nil {
+			t.Errorf("%s: unable to unlock: %v", name, err)
+		}
+		if err := l.Lock(ctx, "router1", "b", 20*time.Millisecond); err != nil {
+			t.Errorf("%s: unable to lock released target: %v", name, err)
+		}
+		time.Sleep(30 * time.Millisecond)
+		if err := l.Lock(ctx, "router1", "a", time.Minute); err != nil {
+			t.Errorf("%s: lease did not expire: %v", name, err)
+		}
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	svipul.Config.LockWait = svipul.Duration(time.Second)
+	ttl := svipul.Config.LockTTL
+	defer func() { svipul.Config.LockTTL = ttl }()
+	svipul.Config.LockTTL = svipul.Duration(60 * time.Millisecond)
+
+	h, err := LockHost(context.Background(), "router2")
+	if err != nil {
+		t.Fatalf("unable to lock free host: %v", err)
+	}
+	// Renewal keeps the lease, and the context, alive past the TTL
+	time.Sleep(150 * time.Millisecond)
+	if err := h.Context().Err(); err != nil {
+		t.Fatalf("context done while holding the lease: %v", err)
+	}
+
+	b, _ := backend()
+	m := b.(*Memory)
+	m.lock.Lock()
+	m.leases["router2"] = Lease{Owner: "thief", Expires: time.Now().Add(time.Minute)}
+	m.lock.Unlock()
+	select {
+	case <-h.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatalf("context not cancelled after losing the lease")
+	}
+	if cause := context.Cause(h.Context()); !errors.Is(cause, ErrLeaseLost) {
+		t.Errorf("expected ErrLeaseLost, got %v", cause)
+	}
+	h.Unlock()
+	m.Unlock(context.Background(), "router2", "thief")
+
+	h, err = LockHost(context.Background(), "router2")
+	if err != nil {
+		t.Fatalf("unable to lock free host: %v", err)
+	}
+	ctx := h.Context()
+	h.Unlock()
+	if cause := context.Cause(ctx); cause == nil || errors.Is(cause, ErrLeaseLost) {
+		t.Errorf("expected the context to be cancelled by Unlock, got %v", cause)
+	}
+}
@@ -0,0 +1,257 @@
+/*
+ * svipul host lock backends
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package inventory
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/telenornms/svipul"
+)
+
+// ErrLocked is returned by a Locker when someone else holds the lease.
+var ErrLocked = errors.New("target locked by another worker")
+
+// ErrLockBackend is returned by LockHost when the lock backend fails, e.g.
+// when svipul-lockd can't be reached, as opposed to the target being busy.
+var ErrLockBackend = errors.New("lock backend failed")
+
+// Locker is a lock backend, keeping workers from polling the same target
+// at the same time. Locks are leases: they expire after the TTL unless
+// renewed, so a worker that dies doesn't keep its targets locked forever.
+//
+// Within a worker, orders for a target are already serialized by
+// LockHost, so a Locker only has to deal with one owner per worker.
+type Locker interface {
+	// Lock takes the lease on target for owner, or renews it if owner
+	// already holds it. It returns ErrLocked if another owner holds an
+	// unexpired lease.
+	Lock(ctx context.Context, target string, owner string, ttl time.Duration) error
+	// Unlock releases the lease, if owner holds it.
+	Unlock(ctx context.Context, target string, owner string) error
+}
+
+// Lease is the holder of a lock, as reported by svipul-lockd.
+type Lease struct {
+	Owner   string
+	Expires time.Time
+}
+
+// Memory is an in-process Locker. It is what a worker uses on its own,
+// and what svipul-lockd uses to serve leases to a cluster of workers.
+type Memory struct {
+	lock   sync.Mutex
+	leases map[string]Lease
+}
+
+func (m *Memory) Lock(ctx context.Context, target string, owner string, ttl time.Duration) error {
+	now := time.Now()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.leases == nil {
+		m.leases = make(map[string]Lease)
+	}
+	if l, ok := m.leases[target]; ok && l.Owner != owner && now.Before(l.Expires) {
+		return fmt.Errorf("%w: held by %s until %s", ErrLocked, l.Owner, l.Expires.Format(time.RFC3339))
+	}
+	m.leases[target] = Lease{Owner: owner, Expires: now.Add(ttl)}
+	return nil
+}
+
+func (m *Memory) Unlock(ctx context.Context, target string, owner string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	l, ok := m.leases[target]
+	if !ok {
+		return nil
+	}
+	if l.Owner != owner && time.Now().Before(l.Expires) {
+		return fmt.Errorf("%w: held by %s, not %s", ErrLocked, l.Owner, owner)
+	}
+	delete(m.leases, target)
+	return nil
+}
+
+// Lease returns the current lease on target, if any.
+func (m *Memory) Lease(target string) (Lease, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	l, ok := m.leases[target]
+	if !ok || !time.Now().Before(l.Expires) {
+		return Lease{}, false
+	}
+	return l, true
+}
+
+// Expire drops expired leases. They are ignored anyway, this just frees
+// the memory.
+func (m *Memory) Expire() {
+	now := time.Now()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for t, l := range m.leases {
+		if !now.Before(l.Expires) {
+			delete(m.leases, t)
+		}
+	}
+}
+
+// NewLockHandler serves the leases of m over HTTP, for HTTPLocker. All
+// requests go to /lock, with the target, owner and TTL as query
+// parameters:
+//
+//	PUT /lock?target=router1&owner=worker1&ttl=30s   take or renew a lease
+//	DELETE /lock?target=router1&owner=worker1        release it
+//	GET /lock?target=router1                         current lease, as JSON
+//
+// Conflicts are answered with 409 Conflict.
+func NewLockHandler(m *Memory) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lock", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		target := q.Get("target")
+		owner := q.Get("owner")
+		if target == "" {
+			http.Error(w, "missing target", http.StatusBadRequest)
+			return
+		}
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			l, ok := m.Lease(target)
+			if !ok {
+				http.Error(w, "not locked", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(l)
+			return
+		case http.MethodPut:
+			var ttl time.Duration
+			ttl, err = time.ParseDuration(q.Get("ttl"))
+			if err != nil || ttl <= 0 || owner == "" {
+				http.Error(w, "missing owner or invalid ttl", http.StatusBadRequest)
+				return
+			}
+			err = m.Lock(r.Context(), target, owner, ttl)
+		case http.MethodDelete:
+			if owner == "" {
+				http.Error(w, "missing owner", http.StatusBadRequest)
+				return
+			}
+			err = m.Unlock(r.Context(), target, owner)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if errors.Is(err, ErrLocked) {
+			svipul.Debugf("%s: %s for %s: %s", r.RemoteAddr, r.Method, target, err)
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		svipul.Debugf("%s: %s for %s by %s", r.RemoteAddr, r.Method, target, owner)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+// HTTPLocker is a Locker using svipul-lockd, shared by all the workers
+// using the same server.
+type HTTPLocker struct {
+	URL    string       // Base URL, e.g. http://lockd.example.com:8161
+	Client *http.Client // nil == a client with a 5 second timeout
+}
+
+func (h *HTTPLocker) Lock(ctx context.Context, target string, owner string, ttl time.Duration) error {
+	return h.do(ctx, http.MethodPut, url.Values{"target": {target}, "owner": {owner}, "ttl": {ttl.String()}})
+}
+
+func (h *HTTPLocker) Unlock(ctx context.Context, target string, owner string) error {
+	return h.do(ctx, http.MethodDelete, url.Values{"target": {target}, "owner": {owner}})
+}
+
+func (h *HTTPLocker) do(ctx context.Context, method string, q url.Values) error {
+	client := h.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(h.URL, "/")+"/lock?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		msg := strings.TrimPrefix(strings.TrimSpace(string(body)), ErrLocked.Error()+": ")
+		return fmt.Errorf("%w: %s", ErrLocked, msg)
+	default:
+		return fmt.Errorf("lock server returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+}
+
+var (
+	lockerOnce sync.Once
+	locker     Locker
+	owner      string
+)
+
+// backend returns the Locker used by LockHost, and the owner name of this
+// worker: host name, process ID and a random suffix, so it's both unique
+// and recognizable when inspecting a lease.
+func backend() (Locker, string) {
+	lockerOnce.Do(func() {
+		host, _ := os.Hostname()
+		b := make([]byte, 4)
+		rand.Read(b)
+		owner = fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+		if svipul.Config.LockServer != "" {
+			locker = &HTTPLocker{URL: svipul.Config.LockServer}
+		} else {
+			locker = &Memory{}
+		}
+	})
+	return locker, owner
+}
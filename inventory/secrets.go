@@ -0,0 +1,135 @@
+/*
+ * svipul named credentials
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package inventory
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/telenornms/svipul"
+)
+
+// ErrUnknownCredential is returned by LookupCredential, and LockHost, for
+// a credential that is neither in the secrets file nor the environment.
+var ErrUnknownCredential = errors.New("unknown credential")
+
+// The secrets file, if any, see LoadSecrets.
+var secrets struct {
+	lock        sync.RWMutex
+	path        string
+	credentials map[string]svipul.Credential
+}
+
+// LoadSecrets reads named credentials from the TOML file f, one table per
+// credential, with the fields of svipul.Credential:
+//
+//	[core-ro]
+//	Community = "s3cret"
+//
+//	[core-v3.V3]
+//	Username = "svipul"
+//	AuthPassphrase = "password"
+//
+// Orders and the inventory can then refer to credentials by name, so the
+// secrets themselves stay on the worker. Unknown keys are errors, so a
+// misspelled field isn't silently ignored. If the file can't be read or
+// has errors, the credentials in use are kept.
+func LoadSecrets(f string) error {
+	var c map[string]svipul.Credential
+	md, err := toml.DecodeFile(f, &c)
+	if err == nil {
+		err = undecoded(md)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", f, err)
+	}
+	for name, cred := range c {
+		if cred.Community == "" && cred.V3 == nil {
+			return fmt.Errorf("%s: credential %s has neither Community nor V3", f, name)
+		}
+		cred.Name = name
+		c[name] = cred
+	}
+	secrets.lock.Lock()
+	defer secrets.lock.Unlock()
+	secrets.path = f
+	secrets.credentials = c
+	return nil
+}
+
+// ReloadSecrets reads the secrets file again, if there is one.
+func ReloadSecrets() error {
+	secrets.lock.RLock()
+	f := secrets.path
+	secrets.lock.RUnlock()
+	if f == "" {
+		return nil
+	}
+	return LoadSecrets(f)
+}
+
+// LookupCredential returns the named credential, from the secrets file or
+// else the environment. In the environment, a credential is a set of
+// variables named SVIPUL_CREDENTIAL_<NAME>_<FIELD>, where NAME is the name
+// in upper case with anything but letters and digits replaced by "_", and
+// FIELD is VERSION, COMMUNITY, or one of the V3 fields: USERNAME, LEVEL,
+// AUTHPROTOCOL, AUTHPASSPHRASE, PRIVPROTOCOL, PRIVPASSPHRASE and CONTEXT.
+// E.g. SVIPUL_CREDENTIAL_CORE_RO_COMMUNITY for "core-ro".
+func LookupCredential(name string) (svipul.Credential, error) {
+	secrets.lock.RLock()
+	c, ok := secrets.credentials[name]
+	secrets.lock.RUnlock()
+	if ok {
+		return c, nil
+	}
+	prefix := "SVIPUL_CREDENTIAL_" + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(name)) + "_"
+	env := func(field string) string {
+		return os.Getenv(prefix + field)
+	}
+	c = svipul.Credential{Name: name, Version: env("VERSION"), Community: env("COMMUNITY")}
+	if user := env("USERNAME"); user != "" {
+		c.V3 = &svipul.V3{
+			Username:       user,
+			Level:          env("LEVEL"),
+			AuthProtocol:   env("AUTHPROTOCOL"),
+			AuthPassphrase: env("AUTHPASSPHRASE"),
+			PrivProtocol:   env("PRIVPROTOCOL"),
+			PrivPassphrase: env("PRIVPASSPHRASE"),
+			Context:        env("CONTEXT"),
+		}
+	}
+	if c.Community == "" && c.V3 == nil {
+		return c, fmt.Errorf("%w %q", ErrUnknownCredential, name)
+	}
+	return c, nil
+}
@@ -0,0 +1,103 @@
+/*
+ * svipul named credential tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package inventory
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/telenornms/svipul"
+)
+
+func TestLookupCredential(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "secrets.toml")
+	os.WriteFile(f, []byte(`
+[core-ro]
+Community = "s3cret"
+
+[core-v3.V3]
+Username = "svipul"
+AuthPassphrase = "password"
+`), 0600)
+	if err := LoadSecrets(f); err != nil {
+		t.Fatalf("unable to load secrets: %v", err)
+	}
+	t.Setenv("SVIPUL_CREDENTIAL_EDGE_RO_COMMUNITY", "env-s3cret")
+	t.Setenv("SVIPUL_CREDENTIAL_EDGE_RO_VERSION", "1")
+
+	c, err := LookupCredential("core-ro")
+	if err != nil || c.Community != "s3cret" || c.Name != "core-ro" {
+		t.Errorf("expected core-ro from file, got %+v (%v)", c, err)
+	}
+	c, err = LookupCredential("core-v3")
+	if err != nil || c.V3 == nil || c.V3.AuthPassphrase != "password" {
+		t.Errorf("expected core-v3 from file, got %+v (%v)", c, err)
+	}
+	c, err = LookupCredential("edge-ro")
+	if err != nil || c.Community != "env-s3cret" || c.Version != "1" {
+		t.Errorf("expected edge-ro from environment, got %+v (%v)", c, err)
+	}
+	if _, err := LookupCredential("nope"); !errors.Is(err, ErrUnknownCredential) {
+		t.Errorf("expected ErrUnknownCredential, got %v", err)
+	}
+
+	typo := filepath.Join(t.TempDir(), "typo.toml")
+	os.WriteFile(typo, []byte(`
+[core-ro]
+Comunity = "other"
+Community = "s3cret"
+
+[core-v3.V3]
+Username = "svipul"
+AuthPasphrase = "password"
+`), 0600)
+	err = LoadSecrets(typo)
+	if err == nil || !strings.Contains(err.Error(), "core-ro.Comunity") || !strings.Contains(err.Error(), "core-v3.V3.AuthPasphrase") {
+		t.Errorf("unknown keys not reported: %v", err)
+	}
+	if c, err := LookupCredential("core-v3"); err != nil || c.V3.AuthPassphrase != "password" {
+		t.Errorf("failed load replaced the credentials in use, got %+v (%v)", c, err)
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	v3 := &svipul.V3{Username: "svipul", AuthPassphrase: "authsecret", PrivPassphrase: "privsecret"}
+	c := svipul.Credential{Name: "core", Community: "commsecret", V3: v3}
+	h := Host{Address: "router1", Community: "commsecret", V3: v3}
+	for _, verb := range []string{"%v", "%+v", "%#v", "%s"} {
+		for _, v := range []interface{}{c, &c, h, *v3, v3} {
+			out := fmt.Sprintf(verb, v)
+			if strings.Contains(out, "secret") {
+				t.Errorf("%s of %T leaks secrets: %s", verb, v, out)
+			}
+		}
+	}
+	if v3.AuthPassphrase != "authsecret" {
+		t.Errorf("redaction modified the original")
+	}
+}
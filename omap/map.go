@@ -24,6 +24,7 @@
 package omap
 
 import (
+	"context"
 	"fmt"
 	"github.com/gosnmp/gosnmp"
 	"github.com/telenornms/svipul"
@@ -40,7 +41,7 @@ type OMap struct {
 	Timestamp time.Time   // When was the map created?
 }
 
-func BuildOMap(w svipul.Walker, oid string) (*OMap, error) {
+func BuildOMap(ctx context.Context, w svipul.Walker, oid string) (*OMap, error) {
 	m := &OMap{}
 	var err error
 	m.IdxToName = make(map[string]string)
@@ -53,7 +54,7 @@ func BuildOMap(w svipul.Walker, oid string) (*OMap, error) {
 	if m.Oid.Numeric == "" {
 		return nil, fmt.Errorf("what happened with mib.Lookup? m.Oid: %#v", m.Oid)
 	}
-	err = w.BulkWalk([]svipul.Node{m.Oid}, m.walkCB)
+	err = w.BulkWalk(ctx, []svipul.Node{m.Oid}, m.walkCB)
 	since := time.Since(m.Timestamp).Round(time.Millisecond * 100)
 	if err == nil {
 		svipul.Debugf("omap built with %d elements in %s", len(m.IdxToName), since.String())
@@ -0,0 +1,177 @@
+/*
+ * svipul order modes
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package svipul
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ResolveM is how the OIDs of a result are formatted, see the Result field
+// of orders.
+type ResolveM int
+
+const (
+	Auto ResolveM = iota
+	OID
+	Resolve
+)
+
+// ParseResolveM parses a resolve mode, case insensitive.
+func ParseResolveM(s string) (ResolveM, error) {
+	switch strings.ToLower(s) {
+	case "auto":
+		return Auto, nil
+	case "oid":
+		return OID, nil
+	case "resolve":
+		return Resolve, nil
+	default:
+		return Auto, fmt.Errorf("invalid resolver mode: %s", strings.ToLower(s))
+	}
+}
+
+func (r *ResolveM) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := ParseResolveM(s)
+	if err != nil {
+		return err
+	}
+	*r = v
+	return nil
+}
+
+func (r ResolveM) MarshalJSON() ([]byte, error) {
+	switch r {
+	case Auto:
+		return []byte("\"Auto\""), nil
+	case OID:
+		return []byte("\"OID\""), nil
+	case Resolve:
+		return []byte("\"Resolve\""), nil
+	default:
+		return []byte("\"\""), fmt.Errorf("invalid resolve mode %d!", r)
+	}
+}
+
+// Mode is what an order does.
+type Mode int
+
+const (
+	Walk         Mode = iota // Do a walk
+	Get                      // Get just these oids
+	GetElements              // Get these specific oids, but per elements
+	BuildMap                 // Build an OMap
+	ClearMap                 // Clear the OMap cache
+	Set                      // Set values, requires AllowSet and SetTargets in the config
+	GetNext                  // Get the first instance after each of these oids
+	GetRange                 // Walk these oids, but only the rows between From and To
+	Breaker                  // Report the circuit breaker state of the target
+	ClearBreaker             // Close the circuit breaker of the target
+	Probe                    // Find credentials that work for the target
+)
+
+// ParseMode parses a mode, case insensitive.
+func ParseMode(s string) (Mode, error) {
+	switch strings.ToLower(s) {
+	case "walk":
+		return Walk, nil
+	case "get":
+		return Get, nil
+	case "getelements":
+		return GetElements, nil
+	case "buildmap":
+		return BuildMap, nil
+	case "clearmap":
+		return ClearMap, nil
+	case "set":
+		return Set, nil
+	case "getnext":
+		return GetNext, nil
+	case "getrange":
+		return GetRange, nil
+	case "breaker":
+		return Breaker, nil
+	case "clearbreaker":
+		return ClearBreaker, nil
+	case "probe":
+		return Probe, nil
+	default:
+		return Walk, fmt.Errorf("invalid mode: %s", strings.ToLower(s))
+	}
+}
+
+func (m *Mode) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := ParseMode(s)
+	if err != nil {
+		return err
+	}
+	*m = v
+	return nil
+}
+
+func (m Mode) String() string {
+	switch m {
+	case Walk:
+		return "Walk"
+	case Get:
+		return "Get"
+	case GetElements:
+		return "GetElements"
+	case BuildMap:
+		return "BuildMap"
+	case ClearMap:
+		return "ClearMap"
+	case Set:
+		return "Set"
+	case GetNext:
+		return "GetNext"
+	case GetRange:
+		return "GetRange"
+	case Breaker:
+		return "Breaker"
+	case ClearBreaker:
+		return "ClearBreaker"
+	case Probe:
+		return "Probe"
+	default:
+		return ""
+	}
+}
+
+func (m Mode) MarshalJSON() ([]byte, error) {
+	s := m.String()
+	if s == "" {
+		return []byte("\"\""), fmt.Errorf("invalid mode %d!", m)
+	}
+	return json.Marshal(s)
+}
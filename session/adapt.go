@@ -0,0 +1,113 @@
+/*
+ * svipul adaptive GetBulk max-repetitions
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package session
+
+import (
+	"sync"
+	"time"
+
+	"github.com/telenornms/svipul"
+)
+
+// repetitions remembers the last good max-repetitions per target, so the
+// next walk starts from a known good setting instead of the default.
+var repetitions sync.Map
+
+// maxTimeoutShrinks is how many times a single walk will shrink and retry
+// after a timeout before giving up. Every attempt costs a full timeout
+// (with retries), so this is kept low.
+const maxTimeoutShrinks = 2
+
+// adapter tracks max-repetitions for a single walk. It grows while the
+// agent answers fast and fills the response, and shrinks when the agent
+// says the response is too big or doesn't answer at all.
+//
+// "Fast" means within a quarter of the timeout. "Fills the response"
+// means the agent returned every repetition we asked for: agents that
+// truncate responses to fit their maximum message size will return fewer
+// varbinds, which is a sign that asking for more is pointless.
+type adapter struct {
+	s        *Session
+	reps     int
+	timeouts int
+}
+
+func (s *Session) newAdapter() *adapter {
+	a := &adapter{s: s, reps: s.Timing.MaxRepetitions}
+	if r, ok := repetitions.Load(s.Target); ok {
+		a.reps = r.(int)
+	}
+	if a.reps < 1 {
+		a.reps = 1
+	}
+	if a.reps > svipul.MaxMaxRepetitions {
+		a.reps = svipul.MaxMaxRepetitions
+	}
+	return a
+}
+
+// shrink halves max-repetitions, returning false if it's already at 1 and
+// there's no point in retrying.
+func (a *adapter) shrink() bool {
+	if a.reps <= 1 {
+		return false
+	}
+	a.reps /= 2
+	return true
+}
+
+// shrinkOnTimeout is shrink, if err is a timeout, but gives up after
+// maxTimeoutShrinks. Other errors, like authentication or decoding
+// errors, have nothing to do with the size of the response, so retrying
+// with a smaller one is pointless.
+func (a *adapter) shrinkOnTimeout(err error) bool {
+	if !IsTimeout(err) || a.timeouts >= maxTimeoutShrinks {
+		return false
+	}
+	a.timeouts++
+	return a.shrink()
+}
+
+// observe grows max-repetitions by 50% if the response was fast and full.
+func (a *adapter) observe(elapsed time.Duration, varbinds int, columns int) {
+	if elapsed > time.Duration(a.s.Timing.Timeout)/4 {
+		return
+	}
+	if varbinds < a.reps*columns {
+		return
+	}
+	grown := a.reps + a.reps/2
+	if grown == a.reps {
+		grown++
+	}
+	if grown > svipul.MaxMaxRepetitions {
+		grown = svipul.MaxMaxRepetitions
+	}
+	a.reps = grown
+}
+
+// save stores the current value for the next walk.
+func (a *adapter) save() {
+	repetitions.Store(a.s.Target, a.reps)
+}
@@ -0,0 +1,110 @@
+/*
+ * svipul max-repetitions adapter tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package session
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/telenornms/svipul"
+)
+
+func TestAdapter(t *testing.T) {
+	s := &Session{Target: "adapter-test", Timing: svipul.Timing{MaxRepetitions: 10, Timeout: svipul.Duration(time.Second)}}
+	defer repetitions.Delete(s.Target)
+	a := s.newAdapter()
+	if a.reps != 10 {
+		t.Fatalf("expected to start at MaxRepetitions 10, got %d", a.reps)
+	}
+
+	// Grows by 50% when fast and full, not when slow or truncated
+	a.observe(10*time.Millisecond, 10*3, 3)
+	if a.reps != 15 {
+		t.Errorf("expected a fast, full response to grow to 15, got %d", a.reps)
+	}
+	a.observe(500*time.Millisecond, 15*3, 3)
+	if a.reps != 15 {
+		t.Errorf("expected a slow response not to grow, got %d", a.reps)
+	}
+	a.observe(10*time.Millisecond, 15*3-1, 3)
+	if a.reps != 15 {
+		t.Errorf("expected a truncated response not to grow, got %d", a.reps)
+	}
+	a.reps = 1
+	a.observe(time.Millisecond, 1, 1)
+	if a.reps != 2 {
+		t.Errorf("expected 1 to grow to 2, got %d", a.reps)
+	}
+	a.reps = svipul.MaxMaxRepetitions - 1
+	a.observe(time.Millisecond, a.reps, 1)
+	if a.reps != svipul.MaxMaxRepetitions {
+		t.Errorf("expected growth to stop at %d, got %d", svipul.MaxMaxRepetitions, a.reps)
+	}
+
+	// Shrinks by half, down to 1
+	a.reps = 5
+	if !a.shrink() || a.reps != 2 {
+		t.Errorf("expected 5 to shrink to 2, got %d", a.reps)
+	}
+	if !a.shrink() || a.reps != 1 {
+		t.Errorf("expected 2 to shrink to 1, got %d", a.reps)
+	}
+	if a.shrink() || a.reps != 1 {
+		t.Errorf("expected shrinking 1 to fail, got %d", a.reps)
+	}
+
+	// Only timeouts shrink, and only maxTimeoutShrinks times per walk
+	a.reps = 100
+	for _, err := range []error{errors.New("unable to decode packet"), gosnmp.ErrWrongDigest, context.DeadlineExceeded} {
+		if a.shrinkOnTimeout(err) || a.reps != 100 {
+			t.Errorf("%q shrank to %d", err, a.reps)
+		}
+	}
+	timeout := errors.New("request timeout (after 1 retries)")
+	for i := 0; i < maxTimeoutShrinks; i++ {
+		if !a.shrinkOnTimeout(timeout) {
+			t.Errorf("timeout %d didn't shrink", i+1)
+		}
+	}
+	if a.shrinkOnTimeout(timeout) || a.reps != 100>>maxTimeoutShrinks {
+		t.Errorf("expected to give up after %d timeouts at %d, got %d", maxTimeoutShrinks, 100>>maxTimeoutShrinks, a.reps)
+	}
+
+	// The next walk starts where the last one left off, within limits
+	a.save()
+	if b := s.newAdapter(); b.reps != a.reps {
+		t.Errorf("expected the next walk to start at %d, got %d", a.reps, b.reps)
+	}
+	repetitions.Store(s.Target, 0)
+	if b := s.newAdapter(); b.reps != 1 {
+		t.Errorf("expected at least 1, got %d", b.reps)
+	}
+	repetitions.Store(s.Target, svipul.MaxMaxRepetitions*2)
+	if b := s.newAdapter(); b.reps != svipul.MaxMaxRepetitions {
+		t.Errorf("expected at most %d, got %d", svipul.MaxMaxRepetitions, b.reps)
+	}
+}
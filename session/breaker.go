@@ -0,0 +1,181 @@
+/*
+ * svipul per-target circuit breaker
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/telenornms/svipul"
+)
+
+// ErrCircuitOpen is returned by NewSession when the circuit breaker of the
+// target is open, see BreakerState.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// Breaker states
+const (
+	Closed   = "closed"    // Business as usual
+	Open     = "open"      // Sessions fail without sending anything
+	HalfOpen = "half-open" // The cool-down is over, the next session probes
+)
+
+// BreakerState is the circuit breaker of a single target. It counts
+// consecutive timeouts, and after BreakerTimeouts of them in a row, the
+// breaker opens: for BreakerCooldown, new sessions to the target fail
+// right away with ErrCircuitOpen instead of tying up a worker for the full
+// timeout. After the cool-down it's half-open, and a single session is let
+// through as a probe. If the probe gets an answer, the breaker closes,
+// if it times out, it opens again for another cool-down.
+type BreakerState struct {
+	State     string
+	Timeouts  int       // Consecutive timeouts
+	Opened    time.Time `json:",omitempty"` // When the breaker last opened
+	Until     time.Time `json:",omitempty"` // End of the cool-down
+	LastError string    `json:",omitempty"` // The timeout that opened it
+}
+
+type breaker struct {
+	lock    sync.Mutex
+	state   BreakerState
+	probing bool // A half-open probe is in flight
+}
+
+// breakers holds the breaker of each target.
+var breakers sync.Map
+
+func breakerFor(target string) *breaker {
+	b, _ := breakers.LoadOrStore(target, &breaker{state: BreakerState{State: Closed}})
+	return b.(*breaker)
+}
+
+// update moves an open breaker to half-open once the cool-down is over.
+// Must be called with the lock held.
+func (b *breaker) update(now time.Time) {
+	if b.state.State == Open && !now.Before(b.state.Until) {
+		b.state.State = HalfOpen
+	}
+}
+
+// Breaker returns the circuit breaker state of a target.
+func Breaker(target string) BreakerState {
+	v, ok := breakers.Load(target)
+	if !ok {
+		return BreakerState{State: Closed}
+	}
+	b := v.(*breaker)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.update(time.Now())
+	return b.state
+}
+
+// ClearBreaker closes the circuit breaker of a target and resets the
+// timeout count.
+func ClearBreaker(target string) {
+	breakers.Delete(target)
+}
+
+// admit checks the breaker before a session is set up, returning
+// ErrCircuitOpen if it's open, or half-open with a probe in flight.
+func (s *Session) admit() error {
+	if svipul.Config.BreakerTimeouts < 1 || s.unguarded {
+		return nil
+	}
+	b := breakerFor(s.Target)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.update(time.Now())
+	switch b.state.State {
+	case Open:
+		return fmt.Errorf("%w for %s until %s, after %d consecutive timeouts", ErrCircuitOpen, s.Target, b.state.Until.Format(time.RFC3339), b.state.Timeouts)
+	case HalfOpen:
+		if b.probing {
+			return fmt.Errorf("%w for %s, waiting for a probe to finish", ErrCircuitOpen, s.Target)
+		}
+		svipul.Logf("%s: circuit breaker half-open, probing", s.Target)
+		b.probing = true
+		s.probe = true
+	}
+	return nil
+}
+
+// IsTimeout returns true if err is the target not answering in time, as
+// opposed to the order running out of time.
+func IsTimeout(err error) bool {
+	return err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) && strings.Contains(err.Error(), "timeout")
+}
+
+// observe updates the breaker with the outcome of a request. Only
+// timeouts count against the target: running out of time for the order
+// says nothing about it, and an error response means it's alive.
+func (s *Session) observe(err error) {
+	if svipul.Config.BreakerTimeouts < 1 || s.unguarded {
+		return
+	}
+	timeout := IsTimeout(err)
+	if err != nil && !timeout {
+		return
+	}
+	b := breakerFor(s.Target)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if s.probe {
+		b.probing = false
+		s.probe = false
+	}
+	if !timeout {
+		if b.state.State != Closed {
+			svipul.Logf("%s: circuit breaker closed", s.Target)
+		}
+		b.state = BreakerState{State: Closed}
+		return
+	}
+	b.state.Timeouts++
+	if b.state.State != Closed || b.state.Timeouts >= svipul.Config.BreakerTimeouts {
+		now := time.Now()
+		b.state.State = Open
+		b.state.Opened = now
+		b.state.Until = now.Add(time.Duration(svipul.Config.BreakerCooldown))
+		b.state.LastError = err.Error()
+		svipul.Logf("%s: circuit breaker opened until %s after %d consecutive timeouts", s.Target, b.state.Until.Format(time.RFC3339), b.state.Timeouts)
+	}
+}
+
+// endProbe lets another session probe, if this session was the probe but
+// never got to find out whether the target is back.
+func (s *Session) endProbe() {
+	if !s.probe {
+		return
+	}
+	b := breakerFor(s.Target)
+	b.lock.Lock()
+	b.probing = false
+	b.lock.Unlock()
+	s.probe = false
+}
@@ -0,0 +1,104 @@
+/*
+ * svipul circuit breaker tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package session
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/telenornms/svipul"
+	"github.com/telenornms/svipul/inventory"
+)
+
+func TestBreaker(t *testing.T) {
+	defer func(timeouts int, cooldown svipul.Duration) {
+		svipul.Config.BreakerTimeouts = timeouts
+		svipul.Config.BreakerCooldown = cooldown
+	}(svipul.Config.BreakerTimeouts, svipul.Config.BreakerCooldown)
+	svipul.Config.BreakerTimeouts = 2
+	svipul.Config.BreakerCooldown = svipul.Duration(200 * time.Millisecond)
+
+	// An agent that never answers
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to start agent: %v", err)
+	}
+	defer conn.Close()
+	target := conn.LocalAddr().String()
+	defer ClearBreaker(target)
+	retries := 0
+	host := inventory.Host{Address: target, Community: "public"}
+	host.Timing = svipul.Timing{Timeout: svipul.MinTimeout, Retries: &retries}
+	nodes := []svipul.Node{{Numeric: "1.3.6.1.2.1.1.5", Qualified: "1.3.6.1.2.1.1.5.0"}}
+	get := func() error {
+		s, err := NewSession(host)
+		if err != nil {
+			return err
+		}
+		defer s.Finalize()
+		return s.Get(context.Background(), nodes, func(pdu gosnmp.SnmpPDU) error { return nil })
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := get(); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("expected get %d to time out, got %v", i, err)
+		}
+	}
+	if state := Breaker(target); state.State != Open || state.Timeouts != 2 {
+		t.Errorf("expected breaker to be open after 2 timeouts, got %+v", state)
+	}
+	start := time.Now()
+	if err := get(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected open breaker to fail, got %v", err)
+	}
+	if since := time.Since(start); since > 50*time.Millisecond {
+		t.Errorf("open breaker took %s to fail", since)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if state := Breaker(target); state.State != HalfOpen {
+		t.Errorf("expected breaker to be half-open after the cool-down, got %+v", state)
+	}
+	probe, err := NewSession(host)
+	if err != nil {
+		t.Fatalf("probe session failed: %v", err)
+	}
+	if _, err := NewSession(host); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected a second session to fail while probing, got %v", err)
+	}
+	probe.Get(context.Background(), nodes, func(pdu gosnmp.SnmpPDU) error { return nil })
+	probe.Finalize()
+	if state := Breaker(target); state.State != Open {
+		t.Errorf("expected breaker to open again after failed probe, got %+v", state)
+	}
+
+	ClearBreaker(target)
+	if state := Breaker(target); state.State != Closed || state.Timeouts != 0 {
+		t.Errorf("expected cleared breaker to be closed, got %+v", state)
+	}
+}
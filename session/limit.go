@@ -0,0 +1,152 @@
+/*
+ * svipul per-target rate limiting
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package session
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/telenornms/svipul"
+)
+
+// limiters holds the limiter of each target. It outlives the sessions,
+// so a burst of orders for the same target is paced too.
+var limiters sync.Map
+
+// limiter paces the requests to a single target, see svipul.Rate.
+type limiter struct {
+	lock  sync.Mutex
+	pdus  bucket
+	bytes bucket
+}
+
+// bucket is a token bucket holding up to a second worth of tokens. It can
+// go into debt, since we don't know how big a response is until we have
+// it: usage is charged after the fact, and the next request waits until
+// the debt is paid off.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last refill.
+func (b *bucket) refill(now time.Time, rate float64, burst float64) {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+	}
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// delay returns how long it takes until the bucket holds need tokens.
+func (b *bucket) delay(need float64, rate float64) time.Duration {
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - b.tokens) / rate * float64(time.Second))
+}
+
+// charge takes what has been used from the buckets, and returns how long
+// to wait before the next request.
+func (l *limiter) charge(now time.Time, r svipul.Rate, pdus int, bytes int) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var wait time.Duration
+	if r.MaxPDURate > 0 {
+		burst := r.MaxPDURate
+		if burst < 1 {
+			burst = 1
+		}
+		l.pdus.refill(now, r.MaxPDURate, burst)
+		l.pdus.tokens -= float64(pdus)
+		wait = l.pdus.delay(1, r.MaxPDURate)
+	}
+	if r.MaxByteRate > 0 {
+		rate := float64(r.MaxByteRate)
+		l.bytes.refill(now, rate, rate)
+		l.bytes.tokens -= float64(bytes)
+		if d := l.bytes.delay(0, rate); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// meter counts what goes through the connection of a rate limited
+// session. gosnmp reads and writes from the goroutine doing the request,
+// so there's no need for locking.
+type meter struct {
+	net.Conn
+	pdus  int
+	bytes int
+}
+
+func (m *meter) Write(b []byte) (int, error) {
+	n, err := m.Conn.Write(b)
+	m.pdus++
+	m.bytes += n
+	return n, err
+}
+
+func (m *meter) Read(b []byte) (int, error) {
+	n, err := m.Conn.Read(b)
+	m.bytes += n
+	return n, err
+}
+
+// charge charges the target with what the session has used since the
+// last time, returning how long to wait before the next request.
+func (s *Session) charge() time.Duration {
+	if s.meter == nil {
+		return 0
+	}
+	l, _ := limiters.LoadOrStore(s.Target, &limiter{})
+	wait := l.(*limiter).charge(time.Now(), s.Rate, s.meter.pdus, s.meter.bytes)
+	s.meter.pdus = 0
+	s.meter.bytes = 0
+	return wait
+}
+
+// pace is called before every request, and waits until the budget of the
+// target allows it, or the context of the session is done.
+func (s *Session) pace() error {
+	wait := s.charge()
+	if wait <= 0 {
+		return nil
+	}
+	svipul.Debugf("%s: rate limited, waiting %s", s.Target, wait)
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-s.S.Context.Done():
+		return s.S.Context.Err()
+	}
+}
@@ -0,0 +1,54 @@
+/*
+ * svipul rate limiting tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package session
+
+import (
+	"testing"
+	"time"
+
+	"github.com/telenornms/svipul"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Now()
+	l := limiter{}
+	r := svipul.Rate{MaxPDURate: 10, MaxByteRate: 1000}
+	if wait := l.charge(now, r, 0, 0); wait != 0 {
+		t.Errorf("fresh limiter should not wait, got %s", wait)
+	}
+	// A second worth of requests empties the bucket
+	if wait := l.charge(now, r, 10, 0); wait != 100*time.Millisecond {
+		t.Errorf("expected to wait 100ms for the next request, got %s", wait)
+	}
+	if wait := l.charge(now.Add(100*time.Millisecond), r, 0, 0); wait != 0 {
+		t.Errorf("expected no wait after 100ms, got %s", wait)
+	}
+	// A big response puts the byte bucket in debt
+	if wait := l.charge(now.Add(100*time.Millisecond), r, 1, 3000); wait != 2*time.Second {
+		t.Errorf("expected to wait 2s to pay off 2000 bytes, got %s", wait)
+	}
+	if wait := l.charge(now.Add(2100*time.Millisecond), svipul.Rate{}, 0, 0); wait != 0 {
+		t.Errorf("unlimited rate should not wait, got %s", wait)
+	}
+}
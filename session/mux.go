@@ -0,0 +1,376 @@
+/*
+ * svipul shared UDP sockets
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/telenornms/svipul"
+)
+
+// Mux lets SNMPv1 and v2c sessions over UDP share a small pool of
+// sockets, instead of opening and closing a socket for every session. At
+// tens of thousands of orders per minute, that churns through file
+// descriptors and ephemeral ports for no good reason.
+//
+// Every socket has a reader that routes responses to the session waiting
+// for them, by the address the response came from and the request ID.
+// Sessions are pinned to a single socket, since agents reply to the
+// address and port the request came from.
+//
+// gosnmp doesn't let us plug in a connection without going through
+// Connect, which also sets up the receive buffer and request IDs. So we
+// keep a pool of gosnmp instances that have been connected once, and
+// swap their connection out for a muxConn. SNMPv3 sessions are not
+// shared, since gosnmp sets up the security parameters in Connect too,
+// and TCP has no reason to be.
+type Mux struct {
+	socks   []*net.UDPConn
+	next    uint32
+	lock    sync.Mutex
+	pending map[muxKey]*muxConn
+	shells  []*gosnmp.GoSNMP
+}
+
+type muxKey struct {
+	addr netip.AddrPort
+	id   uint32
+}
+
+// maxInFlight is how many request IDs a session keeps routed to it. gosnmp
+// accepts responses to any retry of the current request, so this has to
+// cover all retries.
+const maxInFlight = svipul.MaxRetries + 1
+
+var (
+	muxOnce   sync.Once
+	muxShared *Mux
+)
+
+// shared returns the mux used by all sessions, or nil if sockets aren't
+// shared.
+func shared() *Mux {
+	muxOnce.Do(func() {
+		if svipul.Config.SharedSockets < 1 {
+			return
+		}
+		m, err := NewMux(svipul.Config.SharedSockets)
+		if err != nil {
+			svipul.Logf("unable to set up shared sockets, using a socket per session: %s", err)
+			return
+		}
+		muxShared = m
+	})
+	return muxShared
+}
+
+// NewMux opens n shared sockets. The sockets are dual-stack if the system
+// supports it, so both IPv4 and IPv6 targets can use them.
+func NewMux(n int) (*Mux, error) {
+	m := &Mux{pending: make(map[muxKey]*muxConn)}
+	for i := 0; i < n; i++ {
+		sock, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("unable to open shared socket: %w", err)
+		}
+		m.socks = append(m.socks, sock)
+		go m.read(sock)
+	}
+	return m, nil
+}
+
+// Close closes the shared sockets.
+func (m *Mux) Close() {
+	for _, sock := range m.socks {
+		sock.Close()
+	}
+}
+
+// read routes responses from sock to the sessions waiting for them, until
+// the socket is closed. Responses nobody is waiting for, typically late
+// responses to requests that have timed out, are dropped.
+func (m *Mux) read(sock *net.UDPConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := sock.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			svipul.Logf("shared socket read failed: %s", err)
+			continue
+		}
+		id, err := requestID(buf[:n])
+		if err != nil {
+			svipul.Debugf("%s: dropping invalid response: %s", addr, err)
+			continue
+		}
+		key := muxKey{netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port()), id}
+		m.lock.Lock()
+		c := m.pending[key]
+		m.lock.Unlock()
+		if c == nil {
+			svipul.Debugf("%s: dropping response to request %d, nobody is waiting for it", addr, id)
+			continue
+		}
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
+		select {
+		case c.rx <- msg:
+		default:
+			svipul.Debugf("%s: dropping response to request %d, receiver is backed up", addr, id)
+		}
+	}
+}
+
+// open returns a gosnmp instance configured like gs, but using the shared
+// sockets. It has to be returned with release when the session is done.
+func (m *Mux) open(gs *gosnmp.GoSNMP) (*gosnmp.GoSNMP, error) {
+	addr, err := net.ResolveUDPAddr(gs.Transport, net.JoinHostPort(gs.Target, strconv.Itoa(int(gs.Port))))
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve %s: %w", gs.Target, err)
+	}
+	remote := addr.AddrPort()
+	shell, err := m.shell()
+	if err != nil {
+		return nil, err
+	}
+	shell.Target = gs.Target
+	shell.Port = gs.Port
+	shell.Transport = gs.Transport
+	shell.Community = gs.Community
+	shell.Version = gs.Version
+	shell.Timeout = gs.Timeout
+	shell.Retries = gs.Retries
+	shell.ExponentialTimeout = gs.ExponentialTimeout
+	shell.MaxOids = gs.MaxOids
+	shell.Conn = &muxConn{
+		m:      m,
+		sock:   m.socks[atomic.AddUint32(&m.next, 1)%uint32(len(m.socks))],
+		remote: netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port()),
+		rx:     make(chan []byte, maxInFlight),
+		done:   make(chan struct{}),
+	}
+	return shell, nil
+}
+
+// shell returns an unused, previously connected gosnmp instance.
+func (m *Mux) shell() (*gosnmp.GoSNMP, error) {
+	m.lock.Lock()
+	if n := len(m.shells); n > 0 {
+		shell := m.shells[n-1]
+		m.shells = m.shells[:n-1]
+		m.lock.Unlock()
+		return shell, nil
+	}
+	m.lock.Unlock()
+	// Connecting a UDP socket doesn't send anything, so any address
+	// will do.
+	shell := &gosnmp.GoSNMP{
+		Target:    "127.0.0.1",
+		Port:      161,
+		Transport: "udp",
+		Version:   gosnmp.Version2c,
+		Timeout:   time.Second,
+	}
+	err := shell.Connect()
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up shared session: %w", err)
+	}
+	shell.Conn.Close()
+	return shell, nil
+}
+
+// release closes the session's connection and returns the gosnmp
+// instance to the pool.
+func (m *Mux) release(shell *gosnmp.GoSNMP) {
+	shell.Conn.Close()
+	shell.Conn = nil
+	shell.Context = context.Background()
+	m.lock.Lock()
+	m.shells = append(m.shells, shell)
+	m.lock.Unlock()
+}
+
+// muxConn is the connection of a single session using shared sockets. It
+// only implements what gosnmp needs.
+type muxConn struct {
+	m        *Mux
+	sock     *net.UDPConn
+	remote   netip.AddrPort
+	rx       chan []byte
+	ids      []uint32
+	deadline time.Time
+	done     chan struct{}
+	closed   bool
+}
+
+// Write sends a request, and routes responses to it to this connection.
+func (c *muxConn) Write(b []byte) (int, error) {
+	id, err := requestID(b)
+	if err != nil {
+		return 0, fmt.Errorf("unable to find request ID: %w", err)
+	}
+	c.m.lock.Lock()
+	c.m.pending[muxKey{c.remote, id}] = c
+	c.ids = append(c.ids, id)
+	if len(c.ids) > maxInFlight {
+		delete(c.m.pending, muxKey{c.remote, c.ids[0]})
+		c.ids = c.ids[1:]
+	}
+	c.m.lock.Unlock()
+	return c.sock.WriteToUDPAddrPort(b, c.remote)
+}
+
+// Read waits for a response until the deadline. gosnmp detects timeouts
+// by looking for "timeout" in the error, which os.ErrDeadlineExceeded
+// has.
+func (c *muxConn) Read(b []byte) (int, error) {
+	var timeout <-chan time.Time
+	if !c.deadline.IsZero() {
+		t := time.NewTimer(time.Until(c.deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case msg := <-c.rx:
+		return copy(b, msg), nil
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	case <-c.done:
+		return 0, net.ErrClosed
+	}
+}
+
+// Close stops routing responses to this connection.
+func (c *muxConn) Close() error {
+	c.m.lock.Lock()
+	defer c.m.lock.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	for _, id := range c.ids {
+		if c.m.pending[muxKey{c.remote, id}] == c {
+			delete(c.m.pending, muxKey{c.remote, id})
+		}
+	}
+	close(c.done)
+	return nil
+}
+
+func (c *muxConn) LocalAddr() net.Addr {
+	return c.sock.LocalAddr()
+}
+
+func (c *muxConn) RemoteAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.remote)
+}
+
+func (c *muxConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *muxConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
+}
+
+func (c *muxConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// TLV reads a single BER element, returning the tag, value and whatever
+// follows it. It is just enough BER to find our way around the header of
+// an SNMP message without decoding all of it, which is also what
+// svipul-trapd needs it for.
+func TLV(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, fmt.Errorf("truncated message")
+	}
+	l := int(b[1])
+	off := 2
+	if l&0x80 != 0 {
+		n := l & 0x7f
+		if n == 0 || n > 3 || len(b) < off+n {
+			return 0, nil, nil, fmt.Errorf("invalid length")
+		}
+		l = 0
+		for _, c := range b[off : off+n] {
+			l = l<<8 | int(c)
+		}
+		off += n
+	}
+	if len(b)-off < l {
+		return 0, nil, nil, fmt.Errorf("truncated message")
+	}
+	return b[0], b[off : off+l], b[off+l:], nil
+}
+
+// requestID finds the request ID of an SNMPv1 or v2c message, without
+// decoding the rest of it.
+func requestID(msg []byte) (uint32, error) {
+	_, msg, _, err := TLV(msg)
+	if err != nil {
+		return 0, err
+	}
+	// Skip version and community
+	for i := 0; i < 2; i++ {
+		_, _, msg, err = TLV(msg)
+		if err != nil {
+			return 0, err
+		}
+	}
+	tag, pdu, _, err := TLV(msg)
+	if err != nil {
+		return 0, err
+	}
+	if tag&0xe0 != 0xa0 {
+		return 0, fmt.Errorf("not a PDU: %#x", tag)
+	}
+	tag, id, _, err := TLV(pdu)
+	if err != nil {
+		return 0, err
+	}
+	if tag != 0x02 || len(id) < 1 || len(id) > 5 {
+		return 0, fmt.Errorf("invalid request ID")
+	}
+	var ret uint32
+	for _, c := range id {
+		ret = ret<<8 | uint32(c)
+	}
+	return ret, nil
+}
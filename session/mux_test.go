@@ -0,0 +1,211 @@
+/*
+ * svipul shared UDP socket tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package session
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/telenornms/svipul"
+	"github.com/telenornms/svipul/inventory"
+)
+
+// agent starts a minimal SNMP agent on localhost, answering every request
+// with the OIDs asked for and the address of the agent as value.
+func agent(t testing.TB) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to start agent: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	addr := conn.LocalAddr().String()
+	go func() {
+		buf := make([]byte, 65535)
+		dec := &gosnmp.GoSNMP{}
+		for {
+			n, remote, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			pkt, err := dec.SnmpDecodePacket(buf[:n])
+			if err != nil {
+				continue
+			}
+			pkt.PDUType = gosnmp.GetResponse
+			for i := range pkt.Variables {
+				pkt.Variables[i].Type = gosnmp.OctetString
+				pkt.Variables[i].Value = addr
+			}
+			out, err := pkt.MarshalMsg()
+			if err != nil {
+				continue
+			}
+			conn.WriteToUDP(out, remote)
+		}
+	}()
+	return addr
+}
+
+// useMux sets the mux used by new sessions, nil meaning a socket per
+// session.
+func useMux(m *Mux) {
+	muxOnce.Do(func() {})
+	muxShared = m
+}
+
+// get does a single Get of sysName.0 in a new session.
+func get(target string) (string, error) {
+	s, err := NewSession(inventory.Host{Address: target, Community: "public"})
+	if err != nil {
+		return "", err
+	}
+	defer s.Finalize()
+	var value string
+	err = s.Get(context.Background(), []svipul.Node{{Numeric: "1.3.6.1.2.1.1.5", Qualified: "1.3.6.1.2.1.1.5.0"}}, func(pdu gosnmp.SnmpPDU) error {
+		b, ok := pdu.Value.([]byte)
+		if !ok {
+			return fmt.Errorf("unexpected value %v", pdu.Value)
+		}
+		value = string(b)
+		return nil
+	})
+	return value, err
+}
+
+func TestRequestID(t *testing.T) {
+	gs := &gosnmp.GoSNMP{Version: gosnmp.Version2c, Community: "public"}
+	gs.SetRequestID(123455)
+	msg, err := gs.SnmpEncodePacket(gosnmp.GetRequest, []gosnmp.SnmpPDU{{Name: ".1.3.6.1.2.1.1.5.0", Type: gosnmp.Null}}, 0, 0)
+	if err != nil {
+		t.Fatalf("encoding failed: %v", err)
+	}
+	id, err := requestID(msg)
+	if err != nil || id != 123456 {
+		t.Errorf("expected request ID 123456, got %d (%v)", id, err)
+	}
+	if _, err := requestID(msg[:len(msg)/2]); err == nil {
+		t.Errorf("truncated message accepted")
+	}
+}
+
+func TestMux(t *testing.T) {
+	m, err := NewMux(2)
+	if err != nil {
+		t.Fatalf("unable to set up mux: %v", err)
+	}
+	defer m.Close()
+	useMux(m)
+	defer useMux(nil)
+	agents := []string{agent(t), agent(t), agent(t)}
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			value, err := get(target)
+			if err != nil {
+				t.Errorf("%s: get failed: %v", target, err)
+			} else if value != target {
+				t.Errorf("%s: got response from %s", target, value)
+			}
+		}(agents[i%len(agents)])
+	}
+	wg.Wait()
+	if len(m.pending) != 0 {
+		t.Errorf("%d requests still routed after all sessions are done", len(m.pending))
+	}
+}
+
+// BenchmarkSessions compares a socket per session with shared sockets,
+// running a session with a single Get per iteration, in parallel, against
+// a handful of agents.
+func BenchmarkSessions(b *testing.B) {
+	agents := []string{agent(b), agent(b), agent(b), agent(b)}
+	run := func(b *testing.B) {
+		var n uint32
+		var lock sync.Mutex
+		b.RunParallel(func(pb *testing.PB) {
+			lock.Lock()
+			target := agents[n%uint32(len(agents))]
+			n++
+			lock.Unlock()
+			for pb.Next() {
+				if _, err := get(target); err != nil {
+					b.Errorf("get failed: %v", err)
+				}
+			}
+		})
+	}
+	b.Run("socket-per-session", func(b *testing.B) {
+		useMux(nil)
+		run(b)
+	})
+	b.Run("shared", func(b *testing.B) {
+		m, err := NewMux(4)
+		if err != nil {
+			b.Fatalf("unable to set up mux: %v", err)
+		}
+		defer m.Close()
+		useMux(m)
+		defer useMux(nil)
+		run(b)
+	})
+}
+
+func TestTLV(t *testing.T) {
+	long := append([]byte{0x04, 0x81, 0x80}, make([]byte, 0x80)...)
+	cases := []struct {
+		in    []byte
+		tag   byte
+		value int // Length of the value
+		rest  int // Length of what follows
+	}{
+		{[]byte{0x02, 0x01, 0x05}, 0x02, 1, 0},
+		{[]byte{0x30, 0x03, 0x02, 0x01, 0x05, 0xff}, 0x30, 3, 1},
+		{[]byte{0x04, 0x00}, 0x04, 0, 0},
+		{long, 0x04, 0x80, 0},
+	}
+	for _, c := range cases {
+		tag, value, rest, err := TLV(c.in)
+		if err != nil || tag != c.tag || len(value) != c.value || len(rest) != c.rest {
+			t.Errorf("TLV(% x): expected tag %#x, %d bytes of value and %d after, got %#x, %d, %d, %v", c.in, c.tag, c.value, c.rest, tag, len(value), len(rest), err)
+		}
+	}
+	for _, bad := range [][]byte{
+		nil,
+		{0x02},
+		{0x02, 0x02, 0x05},
+		{0x04, 0x80},
+		{0x04, 0x84, 0x00, 0x00, 0x00, 0x01, 0x00},
+		long[:100],
+	} {
+		if _, _, _, err := TLV(bad); err == nil {
+			t.Errorf("TLV(% x): expected an error", bad)
+		}
+	}
+}
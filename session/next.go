@@ -0,0 +1,221 @@
+/*
+ * svipul GetNext and GetRange
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package session
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/telenornms/svipul"
+)
+
+// span limits a walk to the rows of a column between two indexes, both
+// inclusive. A blank from or to means the start or end of the column.
+// Indexes are numeric, e.g. "5" for ifName.5 or "1.4.192.0.2.1" for a
+// multi-part index.
+type span struct {
+	from string
+	to   string
+}
+
+// parseIndex verifies that idx is a numeric, dotted index.
+func parseIndex(idx string) ([]uint64, error) {
+	parts := strings.Split(strings.Trim(idx, "."), ".")
+	ret := make([]uint64, 0, len(parts))
+	for _, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid index %s: %w", idx, err)
+		}
+		ret = append(ret, n)
+	}
+	return ret, nil
+}
+
+// start returns the OID to start walking column from. Since GetNext and
+// GetBulk return what comes after the OID we ask for, we start right
+// before the first index, by decrementing its last component or dropping
+// it if it's 0. That can return rows before the first index for
+// multi-part indexes, which is why we also have before().
+func (sp span) start(column string) string {
+	if sp.from == "" {
+		return column
+	}
+	idx, err := parseIndex(sp.from)
+	if err != nil {
+		return column
+	}
+	last := len(idx) - 1
+	if idx[last] > 0 {
+		idx[last]--
+	} else {
+		idx = idx[:last]
+	}
+	oid := column
+	for _, n := range idx {
+		oid += "." + strconv.FormatUint(n, 10)
+	}
+	return oid
+}
+
+// before returns true if name is a row of column that comes before the
+// start of the span.
+func (sp span) before(column string, name string) bool {
+	if sp.from == "" {
+		return false
+	}
+	return compareOid(strings.TrimPrefix(name, column+"."), sp.from) < 0
+}
+
+// past returns true if name is a row of column that comes after the end
+// of the span, meaning the column is done.
+func (sp span) past(column string, name string) bool {
+	if sp.to == "" {
+		return false
+	}
+	return compareOid(strings.TrimPrefix(name, column+"."), sp.to) > 0
+}
+
+// GetRange walks one or more columns like BulkWalk, but only returns the
+// rows with an index between from and to, both inclusive. Instead of
+// walking the entire column and discarding what's out of range, it starts
+// right before from and stops as soon as it passes to, so fetching a
+// handful of rows of a huge table is cheap. Either bound may be blank to
+// leave that end open.
+//
+// Columns without any rows in the range are listed in s.Missing as
+// "empty".
+func (s *Session) GetRange(ctx context.Context, nodes []svipul.Node, from string, to string, cb func(pdu gosnmp.SnmpPDU) error) error {
+	sp := span{from: strings.Trim(from, "."), to: strings.Trim(to, ".")}
+	if sp.from != "" {
+		if _, err := parseIndex(sp.from); err != nil {
+			return err
+		}
+	}
+	if sp.to != "" {
+		if _, err := parseIndex(sp.to); err != nil {
+			return err
+		}
+	}
+	if sp.from != "" && sp.to != "" && compareOid(sp.from, sp.to) > 0 {
+		return fmt.Errorf("invalid range, %s is after %s", sp.from, sp.to)
+	}
+	return s.bulkWalk(ctx, nodes, sp, cb)
+}
+
+// GetNext uses SNMP GetNext to fetch the first instance after each of the
+// nodes, e.g. the first row of a sparse table or the row after a known
+// index. Unlike the walks, the result isn't limited to the column: asking
+// for the last row of a column returns whatever comes after it.
+//
+// Like Get, it splits the request if there are more nodes than max-oids
+// or if the response is too big. Nodes that yield nothing are listed in
+// s.Missing.
+func (s *Session) GetNext(ctx context.Context, nodes []svipul.Node, cb func(pdu gosnmp.SnmpPDU) error) error {
+	if len(nodes) < 1 {
+		return fmt.Errorf("refusing to carry out GETNEXT for 0 nodes")
+	}
+	s.use(ctx)
+	s.Missing = make(map[string]string)
+	oids := make([]string, 0, len(nodes))
+	for _, a := range nodes {
+		on := a.Numeric
+		if a.Qualified != "" {
+			on = a.Qualified
+		}
+		oids = append(oids, fmt.Sprintf(".%s", on))
+	}
+	if oids[0] == "." {
+		return fmt.Errorf("corrupt oid-lookup, probably a bug. oids[0] is blank: nodes: %#v", nodes)
+	}
+	batch := s.Timing.MaxOids
+	if batch < 1 || batch > gosnmp.MaxOids {
+		batch = gosnmp.MaxOids
+	}
+	for i := 0; i < len(oids); i += batch {
+		end := i + batch
+		if end > len(oids) {
+			end = len(oids)
+		}
+		err := s.getNext(oids[i:end], cb)
+		if err != nil {
+			return fmt.Errorf("oid getnext failed: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *Session) getNext(oids []string, cb func(pdu gosnmp.SnmpPDU) error) error {
+	if err := s.pace(); err != nil {
+		return err
+	}
+	result, err := s.S.GetNext(oids)
+	s.observe(err)
+	if err != nil {
+		s.forgetEngine()
+		return fmt.Errorf("GetNext failed: %w", err)
+	}
+	if result.Error == gosnmp.TooBig && len(oids) > 1 {
+		half := len(oids) / 2
+		err = s.getNext(oids[:half], cb)
+		if err != nil {
+			return err
+		}
+		return s.getNext(oids[half:], cb)
+	}
+	if result.Error == gosnmp.NoSuchName && s.S.Version == gosnmp.Version1 {
+		idx := int(result.ErrorIndex) - 1
+		if idx < 0 || idx >= len(oids) {
+			return fmt.Errorf("noSuchName with invalid error index %d", result.ErrorIndex)
+		}
+		s.Missing[oids[idx]] = "noSuchName"
+		rest := make([]string, 0, len(oids)-1)
+		rest = append(rest, oids[:idx]...)
+		rest = append(rest, oids[idx+1:]...)
+		if len(rest) == 0 {
+			return nil
+		}
+		return s.getNext(rest, cb)
+	}
+	if result.Error != gosnmp.NoError {
+		return fmt.Errorf("response error: %s", result.Error)
+	}
+	if len(result.Variables) != len(oids) {
+		return fmt.Errorf("GetNext returned %d varbinds for %d oids", len(result.Variables), len(oids))
+	}
+	for i, pdu := range result.Variables {
+		if reason := exception(pdu); reason != "" {
+			s.Missing[oids[i]] = reason
+			continue
+		}
+		err = cb(pdu)
+		if err != nil {
+			return fmt.Errorf("callback returned error: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+/*
+ * svipul credential probing
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package session
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/telenornms/svipul"
+	"github.com/telenornms/svipul/inventory"
+)
+
+// The OIDs asked for by Probe: cheap, and implemented by every agent.
+var probeNodes = []svipul.Node{
+	{Numeric: "1.3.6.1.2.1.1.3", Qualified: "1.3.6.1.2.1.1.3.0"}, // sysUpTime.0
+	{Numeric: "1.3.6.1.2.1.1.2", Qualified: "1.3.6.1.2.1.1.2.0"}, // sysObjectID.0
+}
+
+// Probe checks whether the credentials of h work, with a single Get of
+// sysUpTime.0 and sysObjectID.0, returning their values. Either may be
+// missing if the agent doesn't implement them, but any answer means the
+// credentials are accepted.
+//
+// The circuit breaker is left out of it, since wrong credentials
+// usually time out just like a dead target.
+func Probe(ctx context.Context, h inventory.Host) (uptime uint32, objectID string, err error) {
+	s, err := newSession(h, true)
+	if err != nil {
+		return 0, "", err
+	}
+	defer s.Finalize()
+	err = s.Get(ctx, probeNodes, func(pdu gosnmp.SnmpPDU) error {
+		switch v := pdu.Value.(type) {
+		case uint32:
+			uptime = v
+		case string:
+			objectID = v
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, "", fmt.Errorf("probe failed: %w", err)
+	}
+	return uptime, objectID, nil
+}
@@ -0,0 +1,62 @@
+/*
+ * svipul credential probing tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package session
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/telenornms/svipul"
+	"github.com/telenornms/svipul/inventory"
+)
+
+func TestProbe(t *testing.T) {
+	defer func(timeouts int) {
+		svipul.Config.BreakerTimeouts = timeouts
+	}(svipul.Config.BreakerTimeouts)
+	svipul.Config.BreakerTimeouts = 1
+
+	retries := 0
+	timing := svipul.Timing{Timeout: svipul.MinTimeout, Retries: &retries}
+	if _, _, err := Probe(context.Background(), inventory.Host{Address: agent(t), Community: "public", Timing: timing}); err != nil {
+		t.Errorf("probe of live agent failed: %v", err)
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to start agent: %v", err)
+	}
+	defer conn.Close()
+	target := conn.LocalAddr().String()
+	defer ClearBreaker(target)
+	for i := 0; i < 2; i++ {
+		if _, _, err := Probe(context.Background(), inventory.Host{Address: target, Community: "wrong", Timing: timing}); err == nil {
+			t.Errorf("probe of silent agent succeeded")
+		}
+	}
+	if state := Breaker(target); state.State != Closed || state.Timeouts != 0 {
+		t.Errorf("probes counted by the breaker: %+v", state)
+	}
+}
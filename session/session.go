@@ -24,50 +24,190 @@
 package session
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gosnmp/gosnmp"
 	"github.com/telenornms/svipul"
+	"github.com/telenornms/svipul/inventory"
 )
 
 type Session struct {
 	S         *gosnmp.GoSNMP
-	Target    string
+	Target    string // host, host:port, [ipv6] or [ipv6]:port
+	Port      uint16 // Used if Target has no port, 0 means 161
+	Transport string // udp, udp4, udp6, tcp, tcp4 or tcp6. Blank means udp
 	Community string
+	Version   string     // 1, 2c or 3. Blank means 3 if V3 is set, otherwise 2c
+	V3        *svipul.V3 // SNMPv3 parameters, required for version 3
+	Timing    svipul.Timing
+	Rate      svipul.Rate // Request budget of the target, see pace
+
+	// Missing is populated by Get, GetNext, GetRange, BulkWalk and
+	// NextWalk with the
+	// requested OIDs (numeric, with leading dot) that yielded nothing,
+	// and why, e.g. noSuchObject or endOfMibView. It's reset on every
+	// call.
+	Missing map[string]string
+
+	engineFailed bool   // Don't cache the v3 engine, something went wrong
+	mux          *Mux   // Set if the session uses the shared sockets
+	meter        *meter // Set if the session is rate limited
+	probe        bool   // The session is probing a half-open breaker
+	unguarded    bool   // The circuit breaker is left out of it, see Probe
+}
+
+// parseVersion maps a version string to a gosnmp version. A blank version
+// is v3 if we have v3 parameters, v2c otherwise.
+func parseVersion(v string, hasV3 bool) (gosnmp.SnmpVersion, error) {
+	switch strings.ToLower(v) {
+	case "1", "v1":
+		return gosnmp.Version1, nil
+	case "2", "2c", "v2c":
+		return gosnmp.Version2c, nil
+	case "3", "v3":
+		return gosnmp.Version3, nil
+	case "":
+		if hasV3 {
+			return gosnmp.Version3, nil
+		}
+		return gosnmp.Version2c, nil
+	default:
+		return gosnmp.Version2c, fmt.Errorf("invalid SNMP version: %s", v)
+	}
+}
+
+// splitTarget splits a target into host and port, accepting plain host
+// names and addresses, host:port, bracketed IPv6 literals with or without
+// a port, and unbracketed IPv6 literals without a port. The returned port
+// is 0 if none was specified.
+func splitTarget(t string) (string, uint16, error) {
+	if t == "" {
+		return "", 0, fmt.Errorf("empty target")
+	}
+	if strings.HasPrefix(t, "[") && strings.HasSuffix(t, "]") {
+		return t[1 : len(t)-1], 0, nil
+	}
+	// More than one colon and no brackets means a bare IPv6 address.
+	if strings.Count(t, ":") != 1 && !strings.HasPrefix(t, "[") {
+		return t, 0, nil
+	}
+	host, port, err := net.SplitHostPort(t)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid target %s: %w", t, err)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return "", 0, fmt.Errorf("invalid port in target %s", t)
+	}
+	return host, uint16(p), nil
+}
+
+// parseTransport validates the transport, defaulting to udp.
+func parseTransport(t string) (string, error) {
+	t = strings.ToLower(t)
+	switch t {
+	case "":
+		return "udp", nil
+	case "udp", "udp4", "udp6", "tcp", "tcp4", "tcp6":
+		return t, nil
+	default:
+		return "", fmt.Errorf("invalid transport: %s", t)
+	}
 }
 
 func (s *Session) init() error {
+	version, err := parseVersion(s.Version, s.V3 != nil)
+	if err != nil {
+		return err
+	}
+	host, port, err := splitTarget(s.Target)
+	if err != nil {
+		return err
+	}
+	if port == 0 {
+		port = s.Port
+	}
+	if port == 0 {
+		port = 161
+	}
+	transport, err := parseTransport(s.Transport)
+	if err != nil {
+		return err
+	}
 	gs := gosnmp.GoSNMP{
-		Port:               161,
-		Transport:          "udp",
+		Port:               port,
+		Transport:          transport,
 		Community:          s.Community,
-		Version:            gosnmp.Version2c,
-		Timeout:            time.Duration(3) * time.Second,
-		Retries:            1,
-		ExponentialTimeout: true,
+		Version:            version,
+		Timeout:            time.Duration(s.Timing.Timeout),
+		Retries:            *s.Timing.Retries,
+		ExponentialTimeout: *s.Timing.ExponentialTimeout,
 		MaxOids:            gosnmp.MaxOids,
 	}
-	gs.Target = s.Target
-	err := gs.Connect()
-	if err != nil {
-		return fmt.Errorf("snmp connect: %w\n", err)
+	gs.Target = host
+	if version == gosnmp.Version3 {
+		if s.V3 == nil {
+			return fmt.Errorf("SNMP version 3 requested, but no v3 parameters provided")
+		}
+		err := s.initV3(&gs)
+		if err != nil {
+			return fmt.Errorf("snmpv3 setup: %w", err)
+		}
+	}
+	if m := shared(); m != nil && version != gosnmp.Version3 && strings.HasPrefix(transport, "udp") {
+		s.S, err = m.open(&gs)
+		if err != nil {
+			return fmt.Errorf("snmp connect: %w", err)
+		}
+		s.mux = m
+	} else {
+		err = gs.Connect()
+		s.observe(err)
+		if err != nil {
+			return fmt.Errorf("snmp connect: %w\n", err)
+		}
+		s.S = &gs
+	}
+	if s.Rate.Limited() {
+		s.meter = &meter{Conn: s.S.Conn}
+		s.S.Conn = s.meter
 	}
-	s.S = &gs
 	return nil
 }
 
+// use makes the requests of the session honor ctx. gosnmp checks it
+// before every attempt, and shortens the timeout to the deadline.
+func (s *Session) use(ctx context.Context) {
+	s.S.Context = ctx
+}
+
 func (s *Session) Finalize() {
+	s.charge()
+	s.endProbe()
+	if s.mux != nil {
+		s.mux.release(s.S)
+		return
+	}
+	if s.S.Version == gosnmp.Version3 {
+		s.saveEngine()
+	}
 	s.S.Conn.Close()
 }
 
 // Get uses SNMP Get to fetch precise OIDs. it will split it into
-// multiple requests if there are more nodes than max-oids.a
-func (s *Session) Get(nodes []svipul.Node, cb func(pdu gosnmp.SnmpPDU) error) error {
+// multiple requests if there are more nodes than max-oids, and split a
+// request in half if the agent says the response is too big.
+func (s *Session) Get(ctx context.Context, nodes []svipul.Node, cb func(pdu gosnmp.SnmpPDU) error) error {
 	if len(nodes) < 1 {
 		return fmt.Errorf("refusing to carry out GET for 0 nodes")
 	}
+	s.use(ctx)
+	s.Missing = make(map[string]string)
 	oids := make([]string, 0, len(nodes))
 	originals := make([]string, 0, len(nodes))
 	for _, a := range nodes {
@@ -82,9 +222,13 @@ func (s *Session) Get(nodes []svipul.Node, cb func(pdu gosnmp.SnmpPDU) error) er
 	if len(oids) < 1 || oids[0] == "." || originals[0] == "." {
 		return fmt.Errorf("corrupt oid-lookup, probably a bug. oids[0] is blank: nodes: %#v", nodes)
 	}
+	batch := s.Timing.MaxOids
+	if batch < 1 || batch > gosnmp.MaxOids {
+		batch = gosnmp.MaxOids
+	}
 	runs := 0
-	for i := 0; i < len(oids); i += 50 {
-		end := i + 50
+	for i := 0; i < len(oids); i += batch {
+		end := i + batch
 		if end > len(oids) {
 			end = len(oids)
 		}
@@ -100,18 +244,47 @@ func (s *Session) Get(nodes []svipul.Node, cb func(pdu gosnmp.SnmpPDU) error) er
 
 func (s *Session) get(oids []string, cb func(pdu gosnmp.SnmpPDU) error) error {
 	originals := oids
+	if err := s.pace(); err != nil {
+		return err
+	}
 	result, err := s.S.Get(oids)
+	s.observe(err)
 	if err != nil {
+		s.forgetEngine()
 		return fmt.Errorf("Get failed: %w", err)
 	}
+	if result.Error == gosnmp.TooBig && len(oids) > 1 {
+		half := len(oids) / 2
+		svipul.Debugf("%s: Get response too big for %d oids, splitting in two", s.Target, len(oids))
+		err = s.get(oids[:half], cb)
+		if err != nil {
+			return err
+		}
+		return s.get(oids[half:], cb)
+	}
+	// SNMPv1 fails the entire request if a single oid doesn't exist,
+	// so drop the offending oid and try again.
+	if result.Error == gosnmp.NoSuchName && s.S.Version == gosnmp.Version1 {
+		idx := int(result.ErrorIndex) - 1
+		if idx < 0 || idx >= len(oids) {
+			return fmt.Errorf("noSuchName with invalid error index %d", result.ErrorIndex)
+		}
+		s.Missing[oids[idx]] = "noSuchName"
+		rest := make([]string, 0, len(oids)-1)
+		rest = append(rest, oids[:idx]...)
+		rest = append(rest, oids[idx+1:]...)
+		if len(rest) == 0 {
+			return nil
+		}
+		return s.get(rest, cb)
+	}
 	if result.Error != gosnmp.NoError {
 		return fmt.Errorf("response error: %s", result.Error)
 	}
 	for _, pdu := range result.Variables {
-		if pdu.Type == gosnmp.EndOfMibView {
-			return fmt.Errorf("issues with pdu (oids: %v), type: %v, pdu: %v", oids, pdu.Type, pdu)
-		} else if pdu.Type == gosnmp.NoSuchObject || pdu.Type == gosnmp.NoSuchInstance {
-			svipul.Debugf("got no such object/no such instance when looking for oid. Ignoring. pdu: %v", pdu)
+		if reason := exception(pdu); reason != "" {
+			svipul.Debugf("got %s when looking for oid. Ignoring. pdu: %v", reason, pdu)
+			s.Missing[pdu.Name] = reason
 			continue
 		}
 		found := false
@@ -134,14 +307,71 @@ func (s *Session) get(oids []string, cb func(pdu gosnmp.SnmpPDU) error) error {
 	return nil
 }
 
+// Set uses SNMP Set to write the provided varbinds in a single request,
+// calling cb for each varbind in the response. It is deliberately not
+// split into multiple requests, since the agent treats a single Set as
+// atomic and we want to keep it that way. It is sent once, without
+// retries: a timeout doesn't tell us whether the agent carried it out, and
+// writing it again might not be harmless.
+func (s *Session) Set(ctx context.Context, pdus []gosnmp.SnmpPDU, cb func(pdu gosnmp.SnmpPDU) error) error {
+	if len(pdus) < 1 {
+		return fmt.Errorf("refusing to carry out SET for 0 varbinds")
+	}
+	if len(pdus) > gosnmp.MaxOids {
+		return fmt.Errorf("refusing to SET %d varbinds in one request, maximum is %d", len(pdus), gosnmp.MaxOids)
+	}
+	s.use(ctx)
+	if err := s.pace(); err != nil {
+		return err
+	}
+	retries := s.S.Retries
+	s.S.Retries = 0
+	result, err := s.S.Set(pdus)
+	s.S.Retries = retries
+	s.observe(err)
+	if err != nil {
+		s.forgetEngine()
+		return fmt.Errorf("Set failed: %w", err)
+	}
+	if result.Error != gosnmp.NoError {
+		return fmt.Errorf("response error: %s (index %d)", result.Error, result.ErrorIndex)
+	}
+	for _, pdu := range result.Variables {
+		err = cb(pdu)
+		if err != nil {
+			return fmt.Errorf("callback returned error: %w", err)
+		}
+	}
+	return nil
+}
+
 // BulkWalk uses SNMP GetBulk to fetch one or more column/table, calling cb
-// for each pdu received.
-func (s *Session) BulkWalk(nodes []svipul.Node, cb func(pdu gosnmp.SnmpPDU) error) error {
+// for each pdu received. For SNMPv1, or agents that have previously
+// rejected GetBulk, it falls back to walking with GetNext.
+//
+// Max-repetitions is adapted as we go, see adapter.
+//
+// Columns that end, or don't exist at all, are dropped from the walk while
+// the rest carry on. Columns that yielded nothing are listed in s.Missing.
+//
+// The walk is aborted if the agent returns OIDs that don't increase, or if
+// it exceeds the MaxVarbinds or MaxWalkTime limits, or when ctx is done.
+func (s *Session) BulkWalk(ctx context.Context, nodes []svipul.Node, cb func(pdu gosnmp.SnmpPDU) error) error {
+	return s.bulkWalk(ctx, nodes, span{}, cb)
+}
+
+// bulkWalk is BulkWalk, limited to the rows within sp.
+func (s *Session) bulkWalk(ctx context.Context, nodes []svipul.Node, sp span, cb func(pdu gosnmp.SnmpPDU) error) error {
+	if s.S.Version == gosnmp.Version1 || s.noBulk() {
+		return s.nextWalk(ctx, nodes, sp, cb)
+	}
+	s.use(ctx)
+	s.Missing = make(map[string]string)
 	oids := make([]string, 0, len(nodes))
 	originals := make([]string, 0, len(nodes))
 	for _, a := range nodes {
 		numeric := fmt.Sprintf(".%s", a.Numeric)
-		oids = append(oids, numeric)
+		oids = append(oids, sp.start(numeric))
 		originals = append(originals, numeric)
 	}
 	iterations := 0
@@ -150,53 +380,176 @@ func (s *Session) BulkWalk(nodes []svipul.Node, cb func(pdu gosnmp.SnmpPDU) erro
 	if oids[0] == "." || originals[0] == "." {
 		return fmt.Errorf("corrupt oid-lookup, probably a bug. oids[0] is blank")
 	}
+	// found counts hits per column, reasons holds why a column
+	// ended, for columns that end without any hits.
+	found := make(map[string]int)
+	reasons := make(map[string]string)
+	a := s.newAdapter()
+	defer a.save()
+	g := s.newGuard(ctx)
 	for ; len(oids) > 0; iterations++ {
-		revmap := make(map[string]string)
-		result, err := s.S.GetBulk(oids, 0, 10)
+		if err := g.iteration(); err != nil {
+			return err
+		}
+		if err := s.pace(); err != nil {
+			return fmt.Errorf("GetBulk aborted after %d iterations: %w", iterations, err)
+		}
+		start := time.Now()
+		result, err := s.S.GetBulk(oids, 0, uint32(a.reps))
+		s.observe(err)
 		if err != nil {
+			if ctx.Err() == nil && a.shrinkOnTimeout(err) {
+				svipul.Debugf("%s: GetBulk failed (%s), retrying with max-repetitions %d", s.Target, err, a.reps)
+				continue
+			}
+			s.forgetEngine()
 			return fmt.Errorf("GetBulk failed after %d iterations: %w", iterations, err)
 		}
-		oids = make([]string, 0, 5)
+		if result.Error == gosnmp.TooBig && a.shrink() {
+			svipul.Debugf("%s: GetBulk response too big, retrying with max-repetitions %d", s.Target, a.reps)
+			continue
+		}
 		if result.Error != gosnmp.NoError {
+			if hits == 0 && misses == 0 && rejectsBulk(result.Error) {
+				svipul.Logf("%s: GetBulk rejected with %s, falling back to GetNext", s.Target, result.Error)
+				bulkless.Store(s.Target, time.Now())
+				return s.nextWalk(ctx, nodes, sp, cb)
+			}
 			return fmt.Errorf("response error: %s", result.Error)
 		}
-		for _, pdu := range result.Variables {
-			if pdu.Type == gosnmp.EndOfMibView || pdu.Type == gosnmp.NoSuchObject || pdu.Type == gosnmp.NoSuchInstance {
-				return fmt.Errorf("walk issues with pdu, type: %v", pdu.Type)
+		a.observe(time.Since(start), len(result.Variables), len(oids))
+		// Varbinds come back as repetitions of the requested
+		// columns, in order, so column i of repetition r is at
+		// r*len(oids)+i. A column is done when it hits an exception
+		// or wanders out of its subtree.
+		done := make([]bool, len(oids))
+		last := make([]string, len(oids))
+		copy(last, oids)
+		for idx, pdu := range result.Variables {
+			col := idx % len(oids)
+			if done[col] {
+				continue
 			}
-			found := false
-			for _, o := range originals {
-				if strings.HasPrefix(pdu.Name, o+".") {
-					found = true
-					revmap[o] = pdu.Name
-					break
-				}
+			if reason := exception(pdu); reason != "" {
+				done[col] = true
+				reasons[originals[col]] = reason
+				continue
 			}
-			if !found {
+			if !strings.HasPrefix(pdu.Name, originals[col]+".") || sp.past(originals[col], pdu.Name) {
+				done[col] = true
 				misses++
-			} else {
-				err = cb(pdu)
-				if err != nil {
-					return fmt.Errorf("callback returned error: %w", err)
-				}
-				hits++
+				continue
+			}
+			if err := g.varbind(last[col], pdu.Name); err != nil {
+				return err
+			}
+			if sp.before(originals[col], pdu.Name) {
+				last[col] = pdu.Name
+				continue
+			}
+			err = cb(pdu)
+			if err != nil {
+				return fmt.Errorf("callback returned error: %w", err)
+			}
+			hits++
+			found[originals[col]]++
+			last[col] = pdu.Name
+		}
+		// Columns without any varbinds in a (truncated) response
+		// are asked for again, but if nothing progressed at all,
+		// something is wrong.
+		progress := false
+		nextOids := make([]string, 0, len(oids))
+		nextOriginals := make([]string, 0, len(oids))
+		for col := range oids {
+			if done[col] {
+				progress = true
+				continue
+			}
+			if last[col] != oids[col] {
+				progress = true
 			}
+			nextOids = append(nextOids, last[col])
+			nextOriginals = append(nextOriginals, originals[col])
 		}
-		for _, r := range revmap {
-			oids = append(oids, r)
+		if !progress {
+			return fmt.Errorf("walk made no progress after %d requests and %d varbinds", iterations+1, g.varbinds)
 		}
+		oids = nextOids
+		originals = nextOriginals
 	}
-	svipul.Debugf("BulkWalk for %d oids done in %d iterations with %d misses and %d hits", len(nodes), iterations, misses, hits)
+	s.setMissing(nodes, found, reasons)
+	svipul.Debugf("BulkWalk for %d oids done in %d iterations with %d misses and %d hits, max-repetitions %d", len(nodes), iterations, misses, hits, a.reps)
 	return nil
 }
 
-func NewSession(target string, community string) (*Session, error) {
+// NewSession sets up a session to the host, using the SNMP version of the
+// host. If the version isn't set, SNMPv3 is used if the host has V3
+// parameters, and v2c with the community otherwise.
+func NewSession(h inventory.Host) (*Session, error) {
+	return newSession(h, false)
+}
+
+func newSession(h inventory.Host, unguarded bool) (*Session, error) {
 	var s Session
-	s.Target = target
-	s.Community = community
-	err := s.init()
+	s.unguarded = unguarded
+	s.Target = h.Address
+	s.Port = h.Port
+	s.Transport = h.Transport
+	s.Community = h.Community
+	s.V3 = h.V3
+	s.Version = h.Version
+	s.Timing = h.Timing.Merge(svipul.Config.Timing)
+	err := s.Timing.Validate()
+	if err != nil {
+		return nil, err
+	}
+	s.Rate = h.Rate.Merge(svipul.Config.Rate)
+	err = s.Rate.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if s.Timing.Timeout == 0 || s.Timing.Retries == nil || s.Timing.ExponentialTimeout == nil || s.Timing.MaxRepetitions == 0 {
+		return nil, fmt.Errorf("incomplete timing parameters, check the configuration")
+	}
+	err = s.admit()
 	if err != nil {
 		return nil, err
 	}
+	err = s.init()
+	if err != nil {
+		s.endProbe()
+		return nil, err
+	}
 	return &s, nil
 }
+
+// exception returns the name of the SNMP exception in pdu, or a blank
+// string if it's a regular value.
+func exception(pdu gosnmp.SnmpPDU) string {
+	switch pdu.Type {
+	case gosnmp.NoSuchObject:
+		return "noSuchObject"
+	case gosnmp.NoSuchInstance:
+		return "noSuchInstance"
+	case gosnmp.EndOfMibView:
+		return "endOfMibView"
+	}
+	return ""
+}
+
+// setMissing records the walked nodes without any hits in s.Missing,
+// using the reason if there is one, or "empty" if the column simply had
+// no rows.
+func (s *Session) setMissing(nodes []svipul.Node, found map[string]int, reasons map[string]string) {
+	for _, n := range nodes {
+		numeric := fmt.Sprintf(".%s", n.Numeric)
+		if found[numeric] > 0 {
+			continue
+		}
+		s.Missing[numeric] = reasons[numeric]
+		if s.Missing[numeric] == "" {
+			s.Missing[numeric] = "empty"
+		}
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ * session tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package session
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/telenornms/svipul"
+	"github.com/telenornms/svipul/inventory"
+)
+
+func TestSetOnce(t *testing.T) {
+	// An agent that counts requests, but never answers
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to start agent: %v", err)
+	}
+	defer conn.Close()
+	var requests int32
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			if _, _, err := conn.ReadFrom(buf); err != nil {
+				return
+			}
+			atomic.AddInt32(&requests, 1)
+		}
+	}()
+	target := conn.LocalAddr().String()
+	defer ClearBreaker(target)
+	retries := 2
+	host := inventory.Host{Address: target, Community: "private"}
+	host.Timing = svipul.Timing{Timeout: svipul.MinTimeout, Retries: &retries}
+	s, err := NewSession(host)
+	if err != nil {
+		t.Fatalf("session creation failed: %v", err)
+	}
+	defer s.Finalize()
+	pdus := []gosnmp.SnmpPDU{{Name: ".1.3.6.1.2.1.1.5.0", Type: gosnmp.OctetString, Value: "router1"}}
+	if err := s.Set(context.Background(), pdus, func(pdu gosnmp.SnmpPDU) error { return nil }); err == nil {
+		t.Fatalf("set without an answer succeeded")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected a single set request, got %d", n)
+	}
+	if s.S.Retries != retries {
+		t.Errorf("retries of the session changed by set: %d", s.S.Retries)
+	}
+}
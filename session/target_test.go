@@ -0,0 +1,75 @@
+/*
+ * svipul session target parsing tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package session
+
+import (
+	"testing"
+)
+
+func TestSplitTarget(t *testing.T) {
+	cases := []struct {
+		in   string
+		host string
+		port uint16
+	}{
+		{"router1", "router1", 0},
+		{"router1:1161", "router1", 1161},
+		{"192.0.2.1", "192.0.2.1", 0},
+		{"192.0.2.1:161", "192.0.2.1", 161},
+		{"2001:db8::1", "2001:db8::1", 0},
+		{"[2001:db8::1]", "2001:db8::1", 0},
+		{"[2001:db8::1]:1161", "2001:db8::1", 1161},
+	}
+	for _, c := range cases {
+		host, port, err := splitTarget(c.in)
+		if err != nil {
+			t.Errorf("splitTarget(%s) failed: %v", c.in, err)
+			continue
+		}
+		if host != c.host || port != c.port {
+			t.Errorf("splitTarget(%s): expected %s/%d, got %s/%d", c.in, c.host, c.port, host, port)
+		}
+	}
+	for _, bad := range []string{"", "router1:", "router1:foo", "router1:70000", "[2001:db8::1]:x"} {
+		_, _, err := splitTarget(bad)
+		if err == nil {
+			t.Errorf("splitTarget(%s) should have failed", bad)
+		}
+	}
+}
+
+func TestParseTransport(t *testing.T) {
+	tr, err := parseTransport("")
+	if err != nil || tr != "udp" {
+		t.Errorf("blank transport should be udp, got %s (%v)", tr, err)
+	}
+	tr, err = parseTransport("TCP6")
+	if err != nil || tr != "tcp6" {
+		t.Errorf("expected tcp6, got %s (%v)", tr, err)
+	}
+	_, err = parseTransport("sctp")
+	if err == nil {
+		t.Errorf("sctp should not be accepted")
+	}
+}
@@ -0,0 +1,214 @@
+/*
+ * svipul SNMPv3 session logic
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package session
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/telenornms/svipul"
+)
+
+// engine is what we remember about an SNMPv3 agent between sessions, so
+// we don't have to do engine ID discovery and key localization for every
+// single order. Boots and Time are as reported by the agent at Stamp.
+// The localized keys are only valid for the passphrases they were
+// generated from, so we keep a fingerprint of those around as well.
+type engine struct {
+	ID          string
+	Boots       uint32
+	Time        uint32
+	Stamp       time.Time
+	ContextID   string
+	SecretKey   []byte
+	PrivacyKey  []byte
+	Fingerprint [sha256.Size]byte
+}
+
+// engines caches engine per target and user name.
+var engines sync.Map
+
+func (s *Session) engineKey() string {
+	return s.Target + "\x00" + s.V3.Username
+}
+
+func fingerprint(v *svipul.V3) [sha256.Size]byte {
+	return sha256.Sum256([]byte(strings.Join([]string{v.AuthProtocol, v.AuthPassphrase, v.PrivProtocol, v.PrivPassphrase}, "\x00")))
+}
+
+// parseLevel figures out the USM message flags, deriving the level from
+// the passphrases if it isn't provided.
+func parseLevel(v *svipul.V3) (gosnmp.SnmpV3MsgFlags, error) {
+	switch strings.ToLower(v.Level) {
+	case "noauthnopriv":
+		return gosnmp.NoAuthNoPriv, nil
+	case "authnopriv":
+		return gosnmp.AuthNoPriv, nil
+	case "authpriv":
+		return gosnmp.AuthPriv, nil
+	case "":
+		if v.PrivPassphrase != "" {
+			return gosnmp.AuthPriv, nil
+		} else if v.AuthPassphrase != "" {
+			return gosnmp.AuthNoPriv, nil
+		}
+		return gosnmp.NoAuthNoPriv, nil
+	default:
+		return gosnmp.NoAuthNoPriv, fmt.Errorf("invalid security level: %s", v.Level)
+	}
+}
+
+func parseAuth(p string) (gosnmp.SnmpV3AuthProtocol, error) {
+	switch strings.ToUpper(p) {
+	case "MD5":
+		return gosnmp.MD5, nil
+	case "SHA", "":
+		return gosnmp.SHA, nil
+	case "SHA224":
+		return gosnmp.SHA224, nil
+	case "SHA256":
+		return gosnmp.SHA256, nil
+	case "SHA384":
+		return gosnmp.SHA384, nil
+	case "SHA512":
+		return gosnmp.SHA512, nil
+	default:
+		return gosnmp.NoAuth, fmt.Errorf("invalid authentication protocol: %s", p)
+	}
+}
+
+func parsePriv(p string) (gosnmp.SnmpV3PrivProtocol, error) {
+	switch strings.ToUpper(p) {
+	case "DES":
+		return gosnmp.DES, nil
+	case "AES", "":
+		return gosnmp.AES, nil
+	case "AES192":
+		return gosnmp.AES192, nil
+	case "AES256":
+		return gosnmp.AES256, nil
+	case "AES192C":
+		return gosnmp.AES192C, nil
+	case "AES256C":
+		return gosnmp.AES256C, nil
+	default:
+		return gosnmp.NoPriv, fmt.Errorf("invalid privacy protocol: %s", p)
+	}
+}
+
+// USM converts SNMPv3 parameters to gosnmp message flags and USM security
+// parameters. Besides sessions, it's used by svipul-trapd to authenticate
+// incoming traps.
+func USM(v *svipul.V3) (gosnmp.SnmpV3MsgFlags, *gosnmp.UsmSecurityParameters, error) {
+	if v.Username == "" {
+		return gosnmp.NoAuthNoPriv, nil, fmt.Errorf("missing user name")
+	}
+	flags, err := parseLevel(v)
+	if err != nil {
+		return flags, nil, err
+	}
+	usm := &gosnmp.UsmSecurityParameters{
+		UserName: v.Username,
+	}
+	if flags&gosnmp.AuthNoPriv != 0 {
+		usm.AuthenticationProtocol, err = parseAuth(v.AuthProtocol)
+		if err != nil {
+			return flags, nil, err
+		}
+		usm.AuthenticationPassphrase = v.AuthPassphrase
+	}
+	if flags&gosnmp.AuthPriv == gosnmp.AuthPriv {
+		usm.PrivacyProtocol, err = parsePriv(v.PrivProtocol)
+		if err != nil {
+			return flags, nil, err
+		}
+		usm.PrivacyPassphrase = v.PrivPassphrase
+	}
+	return flags, usm, nil
+}
+
+// initV3 sets up gs for SNMPv3, re-using a previously discovered engine
+// if we have one.
+func (s *Session) initV3(gs *gosnmp.GoSNMP) error {
+	flags, usm, err := USM(s.V3)
+	if err != nil {
+		return err
+	}
+	if e, ok := engines.Load(s.engineKey()); ok {
+		cached := e.(*engine)
+		usm.AuthoritativeEngineID = cached.ID
+		usm.AuthoritativeEngineBoots = cached.Boots
+		usm.AuthoritativeEngineTime = cached.Time + uint32(time.Since(cached.Stamp).Seconds())
+		if cached.Fingerprint == fingerprint(s.V3) {
+			usm.SecretKey = cached.SecretKey
+			usm.PrivacyKey = cached.PrivacyKey
+		}
+		gs.ContextEngineID = cached.ContextID
+		svipul.Debugf("%s: re-using cached SNMPv3 engine ID %x", s.Target, cached.ID)
+	}
+	gs.Version = gosnmp.Version3
+	gs.SecurityModel = gosnmp.UserSecurityModel
+	gs.MsgFlags = flags
+	gs.SecurityParameters = usm
+	gs.ContextName = s.V3.Context
+	return nil
+}
+
+// saveEngine stores the discovered engine for later sessions.
+func (s *Session) saveEngine() {
+	if s.S == nil || s.engineFailed {
+		return
+	}
+	usm, ok := s.S.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	if !ok || usm.AuthoritativeEngineID == "" {
+		return
+	}
+	e := &engine{
+		ID:          usm.AuthoritativeEngineID,
+		Boots:       usm.AuthoritativeEngineBoots,
+		Time:        usm.AuthoritativeEngineTime,
+		Stamp:       time.Now(),
+		ContextID:   s.S.ContextEngineID,
+		SecretKey:   usm.SecretKey,
+		PrivacyKey:  usm.PrivacyKey,
+		Fingerprint: fingerprint(s.V3),
+	}
+	engines.Store(s.engineKey(), e)
+}
+
+// forgetEngine drops the cached engine, e.g. after a failed request,
+// since the agent might have been replaced or re-keyed. It also prevents
+// Finalize from storing it again. Requests cut short by the context say
+// nothing about the agent, so they don't count.
+func (s *Session) forgetEngine() {
+	if s.S.Version != gosnmp.Version3 || s.S.Context.Err() != nil {
+		return
+	}
+	engines.Delete(s.engineKey())
+	s.engineFailed = true
+}
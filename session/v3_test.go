@@ -0,0 +1,198 @@
+/*
+ * SNMPv3 tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/telenornms/svipul"
+)
+
+func TestParseLevel(t *testing.T) {
+	cases := []struct {
+		v     svipul.V3
+		flags gosnmp.SnmpV3MsgFlags
+		ok    bool
+	}{
+		{svipul.V3{Level: "noAuthNoPriv"}, gosnmp.NoAuthNoPriv, true},
+		{svipul.V3{Level: "authNoPriv"}, gosnmp.AuthNoPriv, true},
+		{svipul.V3{Level: "AUTHPRIV"}, gosnmp.AuthPriv, true},
+		{svipul.V3{}, gosnmp.NoAuthNoPriv, true},
+		{svipul.V3{AuthPassphrase: "a"}, gosnmp.AuthNoPriv, true},
+		{svipul.V3{AuthPassphrase: "a", PrivPassphrase: "p"}, gosnmp.AuthPriv, true},
+		{svipul.V3{Level: "authNoPriv", PrivPassphrase: "p"}, gosnmp.AuthNoPriv, true},
+		{svipul.V3{Level: "authOnly"}, 0, false},
+	}
+	for _, c := range cases {
+		flags, err := parseLevel(&c.v)
+		if (err == nil) != c.ok || (c.ok && flags != c.flags) {
+			t.Errorf("%+v: expected %v (ok: %v), got %v (%v)", c.v, c.flags, c.ok, flags, err)
+		}
+	}
+}
+
+func TestParseAuth(t *testing.T) {
+	cases := []struct {
+		p    string
+		auth gosnmp.SnmpV3AuthProtocol
+		ok   bool
+	}{
+		{"MD5", gosnmp.MD5, true},
+		{"", gosnmp.SHA, true},
+		{"sha", gosnmp.SHA, true},
+		{"SHA224", gosnmp.SHA224, true},
+		{"sha256", gosnmp.SHA256, true},
+		{"SHA384", gosnmp.SHA384, true},
+		{"SHA512", gosnmp.SHA512, true},
+		{"SHA-256", gosnmp.NoAuth, false},
+		{"none", gosnmp.NoAuth, false},
+	}
+	for _, c := range cases {
+		auth, err := parseAuth(c.p)
+		if (err == nil) != c.ok || auth != c.auth {
+			t.Errorf("%q: expected %v (ok: %v), got %v (%v)", c.p, c.auth, c.ok, auth, err)
+		}
+	}
+}
+
+func TestParsePriv(t *testing.T) {
+	cases := []struct {
+		p    string
+		priv gosnmp.SnmpV3PrivProtocol
+		ok   bool
+	}{
+		{"DES", gosnmp.DES, true},
+		{"", gosnmp.AES, true},
+		{"aes", gosnmp.AES, true},
+		{"AES192", gosnmp.AES192, true},
+		{"AES256", gosnmp.AES256, true},
+		{"aes192c", gosnmp.AES192C, true},
+		{"AES256C", gosnmp.AES256C, true},
+		{"3DES", gosnmp.NoPriv, false},
+		{"AES-128", gosnmp.NoPriv, false},
+	}
+	for _, c := range cases {
+		priv, err := parsePriv(c.p)
+		if (err == nil) != c.ok || priv != c.priv {
+			t.Errorf("%q: expected %v (ok: %v), got %v (%v)", c.p, c.priv, c.ok, priv, err)
+		}
+	}
+}
+
+func TestUSM(t *testing.T) {
+	flags, usm, err := USM(&svipul.V3{Username: "svipul", AuthProtocol: "SHA256", AuthPassphrase: "auth", PrivProtocol: "AES256", PrivPassphrase: "priv"})
+	if err != nil || flags != gosnmp.AuthPriv || usm.UserName != "svipul" ||
+		usm.AuthenticationProtocol != gosnmp.SHA256 || usm.AuthenticationPassphrase != "auth" ||
+		usm.PrivacyProtocol != gosnmp.AES256 || usm.PrivacyPassphrase != "priv" {
+		t.Errorf("unexpected USM parameters %v %+v (%v)", flags, usm, err)
+	}
+	// Protocols that aren't used aren't looked at
+	flags, usm, err = USM(&svipul.V3{Username: "svipul", AuthProtocol: "bogus", PrivProtocol: "bogus"})
+	if err != nil || flags != gosnmp.NoAuthNoPriv || usm.AuthenticationProtocol != 0 || usm.PrivacyProtocol != 0 {
+		t.Errorf("unexpected USM parameters %v %+v (%v)", flags, usm, err)
+	}
+	for _, bad := range []svipul.V3{
+		{AuthPassphrase: "auth"},
+		{Username: "svipul", Level: "bogus"},
+		{Username: "svipul", AuthProtocol: "bogus", AuthPassphrase: "auth"},
+		{Username: "svipul", AuthPassphrase: "auth", PrivProtocol: "bogus", PrivPassphrase: "priv"},
+	} {
+		if _, _, err := USM(&bad); err == nil {
+			t.Errorf("%+v: expected an error", bad)
+		}
+	}
+}
+
+func TestEngineCache(t *testing.T) {
+	v3 := &svipul.V3{Username: "svipul", AuthPassphrase: "auth", PrivPassphrase: "priv"}
+	target := "192.0.2.1:161"
+	defer engines.Delete(target + "\x00" + v3.Username)
+
+	// A session that discovered the engine saves it when it's done
+	done := &Session{Target: target, V3: v3, S: &gosnmp.GoSNMP{Version: gosnmp.Version3, ContextEngineID: "ctx"}}
+	done.S.SecurityParameters = &gosnmp.UsmSecurityParameters{
+		AuthoritativeEngineID:    "engine",
+		AuthoritativeEngineBoots: 3,
+		AuthoritativeEngineTime:  1000,
+		SecretKey:                []byte("secret"),
+		PrivacyKey:               []byte("privacy"),
+	}
+	done.saveEngine()
+
+	cases := []struct {
+		name   string
+		v3     *svipul.V3
+		engine string // Expected engine ID, blank if not cached
+		keys   bool   // Expect the localized keys to be re-used
+	}{
+		{"same credentials", &svipul.V3{Username: "svipul", AuthPassphrase: "auth", PrivPassphrase: "priv"}, "engine", true},
+		{"changed auth passphrase", &svipul.V3{Username: "svipul", AuthPassphrase: "other", PrivPassphrase: "priv"}, "engine", false},
+		{"changed privacy protocol", &svipul.V3{Username: "svipul", AuthPassphrase: "auth", PrivProtocol: "AES256", PrivPassphrase: "priv"}, "engine", false},
+		{"other user", &svipul.V3{Username: "other", AuthPassphrase: "auth", PrivPassphrase: "priv"}, "", false},
+	}
+	for _, c := range cases {
+		s := &Session{Target: target, V3: c.v3}
+		gs := gosnmp.GoSNMP{}
+		if err := s.initV3(&gs); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		usm := gs.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+		if usm.AuthoritativeEngineID != c.engine {
+			t.Errorf("%s: expected engine %q, got %q", c.name, c.engine, usm.AuthoritativeEngineID)
+		}
+		if keys := usm.SecretKey != nil || usm.PrivacyKey != nil; keys != c.keys {
+			t.Errorf("%s: expected keys re-used: %v, got %v", c.name, c.keys, keys)
+		}
+		if c.engine == "" {
+			continue
+		}
+		if usm.AuthoritativeEngineBoots != 3 || usm.AuthoritativeEngineTime < 1000 || gs.ContextEngineID != "ctx" {
+			t.Errorf("%s: unexpected engine parameters %+v, context engine %q", c.name, usm, gs.ContextEngineID)
+		}
+	}
+
+	// A failed request drops the engine, and keeps the session from
+	// saving it again
+	failed := &Session{Target: target, V3: v3, S: &gosnmp.GoSNMP{Version: gosnmp.Version3, Context: context.Background()}}
+	failed.S.SecurityParameters = done.S.SecurityParameters
+	failed.forgetEngine()
+	failed.saveEngine()
+	if _, ok := engines.Load(target + "\x00" + v3.Username); ok {
+		t.Errorf("engine still cached after a failed request")
+	}
+
+	// Unless the request was cut short by the context
+	done.saveEngine()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	cut := &Session{Target: target, V3: v3, S: &gosnmp.GoSNMP{Version: gosnmp.Version3, Context: ctx}}
+	cut.forgetEngine()
+	if _, ok := engines.Load(target + "\x00" + v3.Username); !ok || cut.engineFailed {
+		t.Errorf("engine dropped after a request cut short by the context")
+	}
+}
@@ -0,0 +1,236 @@
+/*
+ * svipul GetNext-based walking
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package session
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/telenornms/svipul"
+)
+
+// bulkless tracks targets that have rejected GetBulk, and when, so we go
+// straight to GetNext for them for the next MaxMapAge. After that, GetBulk
+// is given another chance, in case it was a fluke or the agent has been
+// upgraded.
+var bulkless sync.Map
+
+func (s *Session) noBulk() bool {
+	v, ok := bulkless.Load(s.Target)
+	if !ok {
+		return false
+	}
+	if time.Since(v.(time.Time)) > svipul.Config.MaxMapAge {
+		bulkless.Delete(s.Target)
+		return false
+	}
+	return true
+}
+
+// rejectsBulk returns true if an error status in response to the first
+// GetBulk means the agent doesn't do GetBulk. Agents that only speak v1
+// internally answer with v1 errors, which are never used in response to
+// a proper GetBulk. Other errors, like noAccess or genErr, say nothing
+// about GetBulk, and are just errors.
+func rejectsBulk(e gosnmp.SNMPError) bool {
+	switch e {
+	case gosnmp.NoSuchName, gosnmp.BadValue, gosnmp.ReadOnly:
+		return true
+	}
+	return false
+}
+
+// compareOid compares two numeric OIDs (with or without leading dot)
+// component by component, returning -1, 0 or 1 like strings.Compare.
+// Unparsable components are compared as strings, which is good enough to
+// detect loops.
+func compareOid(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "."), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "."), ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aerr := strconv.ParseUint(as[i], 10, 64)
+		bn, berr := strconv.ParseUint(bs[i], 10, 64)
+		if aerr != nil || berr != nil {
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+			continue
+		}
+		if an < bn {
+			return -1
+		} else if an > bn {
+			return 1
+		}
+	}
+	if len(as) < len(bs) {
+		return -1
+	} else if len(as) > len(bs) {
+		return 1
+	}
+	return 0
+}
+
+// guard protects a single walk against buggy agents: it verifies that
+// every column makes lexicographic progress, and enforces MaxVarbinds and
+// MaxWalkTime. Without it, an agent returning the same OID over and over
+// would keep us walking forever, while holding the host lock. It also
+// stops the walk when the context of the order is done.
+type guard struct {
+	s          *Session
+	ctx        context.Context
+	start      time.Time
+	varbinds   int
+	iterations int
+}
+
+func (s *Session) newGuard(ctx context.Context) *guard {
+	return &guard{s: s, ctx: ctx, start: time.Now()}
+}
+
+// iteration is called for each request, and checks the context and the
+// time limit.
+func (g *guard) iteration() error {
+	g.iterations++
+	if err := g.ctx.Err(); err != nil {
+		return fmt.Errorf("walk aborted after %d requests and %d varbinds: %w", g.iterations-1, g.varbinds, err)
+	}
+	max := time.Duration(g.s.Timing.MaxWalkTime)
+	if max > 0 && time.Since(g.start) > max {
+		return fmt.Errorf("walk exceeded maximum duration of %s after %d requests and %d varbinds", max, g.iterations-1, g.varbinds)
+	}
+	return nil
+}
+
+// varbind is called for each varbind received, with the OID that was
+// requested for the column and the OID returned.
+func (g *guard) varbind(prev string, next string) error {
+	g.varbinds++
+	if g.s.Timing.MaxVarbinds > 0 && g.varbinds > g.s.Timing.MaxVarbinds {
+		return fmt.Errorf("walk exceeded maximum of %d varbinds after %d requests, last OID: %s", g.s.Timing.MaxVarbinds, g.iterations, next)
+	}
+	if compareOid(next, prev) <= 0 {
+		return fmt.Errorf("agent returned non-increasing OID %s after %s, aborting walk after %d requests and %d varbinds", next, prev, g.iterations, g.varbinds-1)
+	}
+	return nil
+}
+
+// NextWalk walks one or more columns/tables using GetNext, calling cb for
+// each pdu received. It has the same contract as BulkWalk, but works with
+// SNMPv1 and agents that don't do GetBulk. It's a lot slower, since it
+// only fetches a single row per request. Like BulkWalk, columns that end
+// or don't exist are dropped and listed in s.Missing.
+func (s *Session) NextWalk(ctx context.Context, nodes []svipul.Node, cb func(pdu gosnmp.SnmpPDU) error) error {
+	return s.nextWalk(ctx, nodes, span{}, cb)
+}
+
+// nextWalk is NextWalk, limited to the rows within sp.
+func (s *Session) nextWalk(ctx context.Context, nodes []svipul.Node, sp span, cb func(pdu gosnmp.SnmpPDU) error) error {
+	s.use(ctx)
+	s.Missing = make(map[string]string)
+	oids := make([]string, 0, len(nodes))
+	originals := make([]string, 0, len(nodes))
+	for _, a := range nodes {
+		numeric := fmt.Sprintf(".%s", a.Numeric)
+		oids = append(oids, sp.start(numeric))
+		originals = append(originals, numeric)
+	}
+	if len(oids) < 1 || oids[0] == "." {
+		return fmt.Errorf("corrupt oid-lookup, probably a bug. oids[0] is blank")
+	}
+	iterations := 0
+	hits := 0
+	found := make(map[string]int)
+	reasons := make(map[string]string)
+	g := s.newGuard(ctx)
+	for ; len(oids) > 0; iterations++ {
+		if err := g.iteration(); err != nil {
+			return err
+		}
+		if err := s.pace(); err != nil {
+			return fmt.Errorf("GetNext aborted after %d iterations: %w", iterations, err)
+		}
+		result, err := s.S.GetNext(oids)
+		s.observe(err)
+		if err != nil {
+			s.forgetEngine()
+			return fmt.Errorf("GetNext failed after %d iterations: %w", iterations, err)
+		}
+		// SNMPv1 signals the end of the MIB with noSuchName, pointing
+		// at the offending varbind. Drop that column and try again
+		// with the rest.
+		if result.Error == gosnmp.NoSuchName && s.S.Version == gosnmp.Version1 {
+			idx := int(result.ErrorIndex) - 1
+			if idx < 0 || idx >= len(oids) {
+				return fmt.Errorf("noSuchName with invalid error index %d", result.ErrorIndex)
+			}
+			reasons[originals[idx]] = "noSuchName"
+			oids = append(oids[:idx], oids[idx+1:]...)
+			originals = append(originals[:idx], originals[idx+1:]...)
+			continue
+		}
+		if result.Error != gosnmp.NoError {
+			return fmt.Errorf("response error: %s", result.Error)
+		}
+		if len(result.Variables) != len(oids) {
+			return fmt.Errorf("GetNext returned %d varbinds for %d oids", len(result.Variables), len(oids))
+		}
+		nextOids := make([]string, 0, len(oids))
+		nextOriginals := make([]string, 0, len(oids))
+		for i, pdu := range result.Variables {
+			if reason := exception(pdu); reason != "" {
+				reasons[originals[i]] = reason
+				continue
+			}
+			if !strings.HasPrefix(pdu.Name, originals[i]+".") || sp.past(originals[i], pdu.Name) {
+				continue
+			}
+			if err := g.varbind(oids[i], pdu.Name); err != nil {
+				return err
+			}
+			if sp.before(originals[i], pdu.Name) {
+				nextOids = append(nextOids, pdu.Name)
+				nextOriginals = append(nextOriginals, originals[i])
+				continue
+			}
+			err = cb(pdu)
+			if err != nil {
+				return fmt.Errorf("callback returned error: %w", err)
+			}
+			hits++
+			found[originals[i]]++
+			nextOids = append(nextOids, pdu.Name)
+			nextOriginals = append(nextOriginals, originals[i])
+		}
+		oids = nextOids
+		originals = nextOriginals
+	}
+	s.setMissing(nodes, found, reasons)
+	svipul.Debugf("NextWalk for %d oids done in %d iterations with %d hits", len(nodes), iterations, hits)
+	return nil
+}
@@ -0,0 +1,329 @@
+/*
+ * svipul walk protection tests
+ *
+ * Copyright (c) 2023 Telenor Norge AS
+ * Author(s):
+ *  - Kristian Lyngstøl <kly@kly.no>
+ *
+ * This library is free software; you can redistribute it and/or
+ * modify it under the terms of the GNU Lesser General Public
+ * License as published by the Free Software Foundation; either
+ * version 2.1 of the License, or (at your option) any later version.
+ *
+ * This library is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the GNU
+ * Lesser General Public License for more details.
+ *
+ * You should have received a copy of the GNU Lesser General Public
+ * License along with this library; if not, write to the Free Software
+ * Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA
+ * 02110-1301  USA
+ */
+
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/telenornms/svipul"
+	"github.com/telenornms/svipul/inventory"
+)
+
+func TestCompareOid(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{".1.3.6.1.2.1.2.2.1.2.1", ".1.3.6.1.2.1.2.2.1.2.1", 0},
+		{".1.3.6.1.2.1.2.2.1.2.2", ".1.3.6.1.2.1.2.2.1.2.10", -1},
+		{".1.3.6.1.2.1.2.2.1.2.10", ".1.3.6.1.2.1.2.2.1.2.9", 1},
+		{".1.3.6.1.2.1.2.2.1.2", ".1.3.6.1.2.1.2.2.1.2.1", -1},
+		{"1.3.6.1.2.1.2.2.1.3", ".1.3.6.1.2.1.2.2.1.2.1", 1},
+	}
+	for _, c := range cases {
+		if got := compareOid(c.a, c.b); got != c.want {
+			t.Errorf("compareOid(%s, %s): expected %d, got %d", c.a, c.b, c.want, got)
+		}
+	}
+}
+
+func TestGuard(t *testing.T) {
+	s := &Session{Timing: svipul.Timing{MaxVarbinds: 3}}
+	g := s.newGuard(context.Background())
+	if err := g.iteration(); err != nil {
+		t.Errorf("first iteration failed: %v", err)
+	}
+	if err := g.varbind(".1.3.6.1.2.1.1", ".1.3.6.1.2.1.1.1.0"); err != nil {
+		t.Errorf("increasing oid rejected: %v", err)
+	}
+	if err := g.varbind(".1.3.6.1.2.1.1.1.0", ".1.3.6.1.2.1.1.1.0"); err == nil {
+		t.Errorf("repeated oid accepted")
+	}
+	if err := g.varbind(".1.3.6.1.2.1.1.2.0", ".1.3.6.1.2.1.1.1.0"); err == nil {
+		t.Errorf("decreasing oid accepted")
+	}
+	if err := g.varbind(".1.3.6.1.2.1.1.1.0", ".1.3.6.1.2.1.1.2.0"); err == nil {
+		t.Errorf("varbind limit not enforced")
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	// An agent that never answers
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to start agent: %v", err)
+	}
+	defer conn.Close()
+	s, err := NewSession(inventory.Host{Address: conn.LocalAddr().String(), Community: "public"})
+	if err != nil {
+		t.Fatalf("session creation failed: %v", err)
+	}
+	defer s.Finalize()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = s.BulkWalk(ctx, []svipul.Node{{Numeric: "1.3.6.1.2.1.2.2.1.2"}}, func(pdu gosnmp.SnmpPDU) error {
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected walk to fail with deadline exceeded, got %v", err)
+	}
+	if since := time.Since(start); since > time.Second {
+		t.Errorf("walk took %s, deadline was 200ms", since)
+	}
+}
+
+func TestSpan(t *testing.T) {
+	col := ".1.3.6.1.2.1.31.1.1.1.1"
+	cases := []struct {
+		sp    span
+		start string
+	}{
+		{span{}, col},
+		{span{from: "10"}, col + ".9"},
+		{span{from: "0"}, col},
+		{span{from: "1.4.192.0.2.0"}, col + ".1.4.192.0.2"},
+	}
+	for _, c := range cases {
+		if got := c.sp.start(col); got != c.start {
+			t.Errorf("span %v: expected start %s, got %s", c.sp, c.start, got)
+		}
+	}
+	sp := span{from: "10", to: "20"}
+	if !sp.before(col, col+".9.1") {
+		t.Errorf("%s.9.1 should be before %v", col, sp)
+	}
+	if sp.before(col, col+".10") || sp.past(col, col+".10") {
+		t.Errorf("%s.10 should be within %v", col, sp)
+	}
+	if sp.past(col, col+".20") {
+		t.Errorf("%s.20 should be within %v", col, sp)
+	}
+	if !sp.past(col, col+".20.1") || !sp.past(col, col+".100") {
+		t.Errorf("%s.20.1 and %s.100 should be past %v", col, col, sp)
+	}
+}
+
+// mib is what mibAgent serves.
+type mib struct {
+	vars     []gosnmp.SnmpPDU          // Regular values, any order
+	special  map[string]gosnmp.Asn1BER // Exceptions returned for requests under these OIDs
+	bulkErr  gosnmp.SNMPError          // Error status for every GetBulk
+	getBulks int32                     // GetBulk requests seen
+}
+
+// next returns the first varbind after oid, an exception if oid is under
+// one of the special OIDs, or endOfMibView.
+func (m *mib) next(oid string) gosnmp.SnmpPDU {
+	for prefix, typ := range m.special {
+		if oid == prefix || strings.HasPrefix(oid, prefix+".") {
+			return gosnmp.SnmpPDU{Name: oid, Type: typ}
+		}
+	}
+	for _, v := range m.vars {
+		if compareOid(v.Name, oid) > 0 {
+			return v
+		}
+	}
+	return gosnmp.SnmpPDU{Name: oid, Type: gosnmp.EndOfMibView}
+}
+
+// mibAgent starts an SNMP agent on localhost answering GetNext and GetBulk
+// from m, for walk tests.
+func mibAgent(t testing.TB, m *mib) string {
+	sort.Slice(m.vars, func(i, j int) bool { return compareOid(m.vars[i].Name, m.vars[j].Name) < 0 })
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to start agent: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 65535)
+		dec := &gosnmp.GoSNMP{}
+		for {
+			n, remote, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			pkt, err := dec.SnmpDecodePacket(buf[:n])
+			if err != nil {
+				continue
+			}
+			var vars []gosnmp.SnmpPDU
+			switch pkt.PDUType {
+			case gosnmp.GetNextRequest:
+				for _, v := range pkt.Variables {
+					vars = append(vars, m.next(v.Name))
+				}
+			case gosnmp.GetBulkRequest:
+				atomic.AddInt32(&m.getBulks, 1)
+				if m.bulkErr != gosnmp.NoError {
+					pkt.Error = m.bulkErr
+					pkt.ErrorIndex = 1
+					vars = pkt.Variables
+					break
+				}
+				reps := int(pkt.MaxRepetitions)
+				if reps == 0 {
+					reps = 3
+				}
+				last := make([]string, len(pkt.Variables))
+				for i, v := range pkt.Variables {
+					last[i] = v.Name
+				}
+				for r := 0; r < reps; r++ {
+					for i := range last {
+						v := m.next(last[i])
+						vars = append(vars, v)
+						last[i] = v.Name
+					}
+				}
+			default:
+				continue
+			}
+			pkt.PDUType = gosnmp.GetResponse
+			pkt.NonRepeaters = 0
+			pkt.MaxRepetitions = 0
+			pkt.Variables = vars
+			out, err := pkt.MarshalMsg()
+			if err != nil {
+				continue
+			}
+			conn.WriteToUDP(out, remote)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// walk walks the columns in a new session to target, returning the OIDs
+// found and the session.
+func walk(t *testing.T, target string, columns ...string) ([]string, *Session, error) {
+	s, err := NewSession(inventory.Host{Address: target, Community: "public"})
+	if err != nil {
+		t.Fatalf("session creation failed: %v", err)
+	}
+	defer s.Finalize()
+	var nodes []svipul.Node
+	for _, c := range columns {
+		nodes = append(nodes, svipul.Node{Numeric: strings.TrimPrefix(c, ".")})
+	}
+	var found []string
+	err = s.BulkWalk(context.Background(), nodes, func(pdu gosnmp.SnmpPDU) error {
+		found = append(found, pdu.Name)
+		return nil
+	})
+	sort.Strings(found)
+	return found, s, err
+}
+
+// column returns n integer rows of the column col.
+func column(col string, n int) []gosnmp.SnmpPDU {
+	var vars []gosnmp.SnmpPDU
+	for i := 1; i <= n; i++ {
+		vars = append(vars, gosnmp.SnmpPDU{Name: fmt.Sprintf("%s.%d", col, i), Type: gosnmp.Integer, Value: i})
+	}
+	return vars
+}
+
+func TestBulkFallback(t *testing.T) {
+	col := ".1.3.6.1.2.1.2.2.1.1"
+	for _, c := range []struct {
+		err      gosnmp.SNMPError
+		fallback bool
+	}{
+		{gosnmp.NoSuchName, true},
+		{gosnmp.NoAccess, false},
+		{gosnmp.GenErr, false},
+		{gosnmp.AuthorizationError, false},
+	} {
+		target := mibAgent(t, &mib{vars: column(col, 3), bulkErr: c.err})
+		found, s, err := walk(t, target, col)
+		if c.fallback {
+			if err != nil || len(found) != 3 {
+				t.Errorf("%s: expected fallback to GetNext to find 3 rows, got %v, %v", c.err, found, err)
+			}
+		} else if err == nil {
+			t.Errorf("%s: expected the walk to fail", c.err)
+		}
+		if s.noBulk() != c.fallback {
+			t.Errorf("%s: expected GetBulk to be remembered as unsupported: %v", c.err, c.fallback)
+		}
+		bulkless.Delete(target)
+	}
+
+	// The fallback is forgotten after MaxMapAge
+	target := mibAgent(t, &mib{vars: column(col, 3)})
+	bulkless.Store(target, time.Now().Add(-svipul.Config.MaxMapAge-time.Second))
+	s := &Session{Target: target}
+	if s.noBulk() {
+		t.Errorf("expected GetBulk to be tried again after MaxMapAge")
+	}
+	bulkless.Store(target, time.Now())
+	if !s.noBulk() {
+		t.Errorf("expected GetBulk to be skipped right after falling back")
+	}
+	bulkless.Delete(target)
+}
+
+func TestWalkPartial(t *testing.T) {
+	long := ".1.3.6.1.2.1.2.2.1.2"
+	short := ".1.3.6.1.2.1.2.2.1.3"
+	missing := ".1.3.6.1.2.1.2.2.1.4"
+	broken := ".1.3.6.1.2.1.2.2.1.99"
+	vars := append(column(long, 8), column(short, 2)...)
+	// Something after the walked columns, so they end by leaving
+	// their subtree rather than at endOfMibView
+	vars = append(vars, gosnmp.SnmpPDU{Name: ".1.3.6.1.2.1.2.2.1.100.1", Type: gosnmp.Integer, Value: 1})
+	m := &mib{vars: vars, special: map[string]gosnmp.Asn1BER{broken: gosnmp.NoSuchObject}}
+	target := mibAgent(t, m)
+	defer repetitions.Delete(target)
+	repetitions.Store(target, 3)
+	found, s, err := walk(t, target, long, short, missing, broken)
+	if err != nil {
+		t.Fatalf("walk failed: %v", err)
+	}
+	if n := atomic.LoadInt32(&m.getBulks); n < 2 {
+		t.Errorf("expected the walk to take more than one GetBulk, got %d", n)
+	}
+	var want []string
+	for _, v := range append(column(long, 8), column(short, 2)...) {
+		want = append(want, v.Name)
+	}
+	sort.Strings(want)
+	if strings.Join(found, " ") != strings.Join(want, " ") {
+		t.Errorf("expected the other columns to continue after one ended:\nwant %v\ngot  %v", want, found)
+	}
+	if len(s.Missing) != 2 || s.Missing[missing] != "empty" || s.Missing[broken] != "noSuchObject" {
+		t.Errorf("expected %s to be empty and %s noSuchObject, got %v", missing, broken, s.Missing)
+	}
+}
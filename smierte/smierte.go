@@ -37,6 +37,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/gosnmp/gosnmp"
 	"github.com/sleepinggenius2/gosmi"
 	"github.com/sleepinggenius2/gosmi/types"
 	"github.com/telenornms/svipul"
@@ -123,6 +124,7 @@ func Lookup(item string) (svipul.Node, error) {
 		ret.Format = n.Type.Format
 	}
 	ret.Type = n.Type
+	ret.Access = n.Access
 	if match {
 		index := 0
 		if item[0] == '.' {
@@ -132,3 +134,60 @@ func Lookup(item string) (svipul.Node, error) {
 	}
 	return ret, nil
 }
+
+// Name resolves a numeric OID to the name of the node and the remaining
+// instance, e.g. ".1.3.6.1.2.1.2.2.1.8.3" to "ifOperStatus.3". If the
+// lookup fails, the OID is returned as is.
+func Name(oid string) string {
+	n, err := Lookup(oid)
+	if err != nil || n.Name == "" {
+		return oid
+	}
+	trimmed := strings.TrimPrefix(oid, ".")
+	if !strings.HasPrefix(trimmed, n.Numeric) {
+		return oid
+	}
+	return n.Name + trimmed[len(n.Numeric):]
+}
+
+// Value renders the value of a PDU according to the MIB.
+//
+// The decoding is a bit finnicky. We only want to use the "formatted"
+// stuff for types that require rendering, while numbers should be left
+// intact. And then there's OctetString where we DO want to use DisplayHint
+// if present, but NOT if it isn't present, because the default is
+// atrocious.
+func Value(pdu gosnmp.SnmpPDU) interface{} {
+	node, err := Lookup(pdu.Name)
+	if err != nil {
+		svipul.Logf("PDU/Node lookup failed during callback: %v", err)
+	}
+	if node.Type == nil {
+		return pdu.Value
+	}
+	foo := node.Type.FormatValue(pdu.Value)
+	if node.Type.BaseType == types.BaseTypeUnknown ||
+		node.Type.BaseType == types.BaseTypeObjectIdentifier ||
+		node.Type.BaseType == types.BaseTypeEnum ||
+		node.Type.BaseType == types.BaseTypeBits ||
+		node.Type.BaseType == types.BaseTypePointer {
+		return foo.Formatted
+	} else if node.Type.BaseType == types.BaseTypeOctetString {
+		if node.Type.Format != "" {
+			return foo.Formatted
+		}
+		switch foo.Raw.(type) {
+		case string:
+			return foo.Raw
+		case []uint8:
+			// This one is a bit iffy, since I don't know if
+			// there are problematic octet strings out there,
+			// but I _do_ know hrSWInstalledName will fail to
+			// render sensibly without it.
+			return string(foo.Raw.([]uint8))
+		default:
+			return foo.Formatted
+		}
+	}
+	return pdu.Value
+}